@@ -7,8 +7,10 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"sync"
+	"time"
 
 	oauth2v4 "github.com/go-oauth2/oauth2/v4"
 	digiconfig "github.com/holyhope/digiposte-oauth/config"
@@ -18,18 +20,44 @@ import (
 // AccessGenerator is an oauth2.AccessGenerate that uses a LoginMethod to generate the access token.
 type AccessGenerator struct {
 	setter      digiconfig.Setter
+	getter      digiconfig.Getter
 	loginMethod LoginMethod
+	logins      *loginGroup
 	credentials *sync.Map
+	sessions    *sync.Map
+	relogins    *sync.Map
+	logger      *log.Logger
+	refresher   *refresher
+	cache       *tokenCache
+	signer      *accessTokenSigner
+	openID      *openIDProvider
+
+	expiryMargin time.Duration
 }
 
 var _ oauth2v4.AccessGenerate = (*AccessGenerator)(nil)
 
 const RefreshTokenLength = 32
 
+// DefaultTokenExpiryMargin is the default delay before the Digiposte token expiry at which the issued tokens expire.
+const DefaultTokenExpiryMargin = time.Minute
+
 func (ag *AccessGenerator) SetCredentials(clientID string, creds *Credentials) {
 	ag.credentials.Store(clientID, creds)
 }
 
+// Credentials returns the Digiposte credentials registered for the client.
+func (ag *AccessGenerator) Credentials(clientID string) (*Credentials, bool) {
+	value, ok := ag.credentials.Load(clientID)
+	if !ok {
+		return nil, false
+	}
+
+	creds, ok := value.(*Credentials)
+
+	return creds, ok
+}
+
 func (ag *AccessGenerator) Token(
 	ctx context.Context,
 	generateBasic *oauth2v4.GenerateBasic,
@@ -40,8 +68,16 @@ func (ag *AccessGenerator) Token(
 		return "", "", fmt.Errorf("login: %w", err)
 	}
 
-	if err := digiconfig.SetCookies(ag.setter, cookies); err != nil {
-		return "", "", fmt.Errorf("set cookies: %w", err)
+	if _, err := ag.storeSession(generateBasic.Client.GetID(), digiposteToken, cookies); err != nil {
+		return "", "", err
+	}
+
+	if expiresIn, ok := ag.expiresIn(digiposteToken); ok && generateBasic.TokenInfo != nil {
+		generateBasic.TokenInfo.SetAccessExpiresIn(expiresIn)
+	}
+
+	if ag.signer != nil {
+		return ag.signedTokens(ctx, generateBasic, isGenRefresh)
 	}
 
 	if !isGenRefresh {
@@ -69,6 +105,179 @@ func (ag *AccessGenerator) Token(
 	return digiposteToken.AccessToken, digiposteToken.RefreshToken, nil
 }
 
+// signedTokens issues a signed access token and a random refresh token, along with an ID token if asked for.
+// The Digiposte tokens stay in the session of the client.
+func (ag *AccessGenerator) signedTokens(
+	ctx context.Context,
+	generateBasic *oauth2v4.GenerateBasic,
+	isGenRefresh bool,
+) (string, string, error) {
+	access, err := ag.signer.accessToken(generateBasic)
+	if err != nil {
+		return "", "", fmt.Errorf("sign access token: %w", err)
+	}
+
+	if ag.openID != nil && requestsOpenID(generateBasic.TokenInfo.GetScope()) {
+		creds, _ := ag.Credentials(generateBasic.Client.GetID())
+		if err := ag.openID.issue(ctx, generateBasic, access, creds); err != nil {
+			return "", "", err
+		}
+	}
+
+	if !isGenRefresh {
+		return access, "", nil
+	}
+
+	refresh, err := randomString(RefreshTokenLength)
+	if err != nil {
+		return "", "", fmt.Errorf("generate refresh token: %w", err)
+	}
+
+	return access, refresh, nil
+}
+
+// expiresIn returns the lifetime of the issued token, which expires shortly before the Digiposte token.
+// It returns false if the expiry of the Digiposte token is unknown, in which case the default lifetime is used.
+func (ag *AccessGenerator) expiresIn(digiposteToken *oauth2.Token) (time.Duration, bool) {
+	if digiposteToken.Expiry.IsZero() {
+		return 0, false
+	}
+
+	expiresIn := time.Until(digiposteToken.Expiry) - ag.expiryMargin
+	// A zero lifetime would never expire.
+	if expiresIn < time.Second {
+		expiresIn = time.Second
+	}
+
+	return expiresIn, true
+}
+
+// storeSession persists the cookies and keeps the session of the client for the next refresh.
+func (ag *AccessGenerator) storeSession(
+	clientID string,
+	digiposteToken *oauth2.Token,
+	cookies []*http.Cookie,
+) (*session, error) {
+	creds, hasCreds := ag.Credentials(clientID)
+
+	if hasCreds {
+		if err := ag.persistCookies(creds.Username, cookies); err != nil {
+			return nil, fmt.Errorf("set cookies: %w", err)
+		}
+	}
+
+	current := &session{
+		Token:   digiposteToken,
+		Cookies: cookies,
+	}
+
+	ag.sessions.Store(clientID, current)
+
+	if hasCreds && ag.cache != nil {
+		ag.cache.put(creds, current)
+	}
+
+	if ag.refresher != nil {
+		ag.refresher.track(clientID, digiposteToken.Expiry)
+	}
+
+	return current, nil
+}
+
+// session returns the current Digiposte session of the client, logging in if there is none.
+func (ag *AccessGenerator) session(ctx context.Context, clientID string) (*session, error) {
+	if value, ok := ag.sessions.Load(clientID); ok {
+		return value.(*session), nil //nolint:forcetypeassert
+	}
+
+	return ag.relogin(ctx, clientID, nil)
+}
+
+// relogin replaces the session of the client with a new login, after Digiposte rejected it.
+// The relogins of a client are serialized, so that the requests rejected at once share the first new session.
+func (ag *AccessGenerator) relogin(ctx context.Context, clientID string, rejected *session) (*session, error) {
+	value, _ := ag.relogins.LoadOrStore(clientID, &sync.Mutex{})
+	mutex := value.(*sync.Mutex) //nolint:forcetypeassert
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if value, ok := ag.sessions.Load(clientID); ok && value.(*session) != rejected { //nolint:forcetypeassert
+		return value.(*session), nil //nolint:forcetypeassert
+	}
+
+	creds, _ := ag.Credentials(clientID)
+	if err := areCredentialsValid(creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials: %w", err)
+	}
+
+	if ag.cache != nil {
+		ag.cache.invalidate(creds)
+	}
+
+	digiposteToken, cookies, err := ag.logins.login(ctx, creds)
+	if err != nil {
+		return nil, fmt.Errorf("using %v: %w", ag.loginMethod, err)
+	}
+
+	return ag.storeSession(clientID, digiposteToken, cookies)
+}
+
+// invalidateCache drops the cached Digiposte session of the account of the client,
+// so that the next token is not issued from a session which was revoked.
+func (ag *AccessGenerator) invalidateCache(clientID string) {
+	if creds, ok := ag.Credentials(clientID); ok && ag.cache != nil {
+		ag.cache.invalidate(creds)
+	}
+}
+
+// forget drops the credentials and the session of the client, without logging out of Digiposte.
+func (ag *AccessGenerator) forget(clientID string) {
+	ag.credentials.Delete(clientID)
+	ag.forgetSession(clientID)
+}
+
+// forgetSession drops the session of the client, so that the next token is issued by a new login.
+func (ag *AccessGenerator) forgetSession(clientID string) {
+	ag.sessions.Delete(clientID)
+
+	if ag.refresher != nil {
+		ag.refresher.forget(clientID)
+	}
+}
+
+// EndSession logs the last Digiposte session of the client out and clears the persisted cookies of its account.
+func (ag *AccessGenerator) EndSession(ctx context.Context, clientID string) error {
+	return ag.endSession(ctx, clientID, ag.getter)
+}
+
+// endSession is EndSession with the Digiposte configuration of the client.
+func (ag *AccessGenerator) endSession(ctx context.Context, clientID string, getter digiconfig.Getter) error {
+	if ag.refresher != nil {
+		ag.refresher.forget(clientID)
+	}
+
+	ag.invalidateCache(clientID)
+
+	// The sessions of the other accounts are left alone.
+	if creds, ok := ag.Credentials(clientID); ok {
+		if err := ag.persistCookies(creds.Username, []*http.Cookie{}); err != nil {
+			return fmt.Errorf("clear cookies: %w", err)
+		}
+	}
+
+	value, ok := ag.sessions.LoadAndDelete(clientID)
+	if !ok {
+		return nil
+	}
+
+	if err := value.(*session).logout(ctx, getter); err != nil { //nolint:forcetypeassert
+		return fmt.Errorf("digiposte: %w", err)
+	}
+
+	return nil
+}
+
 func (ag *AccessGenerator) login(
 	ctx context.Context,
 	generateBasic *oauth2v4.GenerateBasic,
@@ -88,7 +297,25 @@ func (ag *AccessGenerator) login(
 		return nil, nil, fmt.Errorf("invalid credentials: %w", err)
 	}
 
-	digiposteToken, cookies, err := ag.loginMethod.Login(ctx, creds)
+	if ag.cache != nil {
+		if cached, ok := ag.cache.get(creds); ok {
+			return cached.Token, cached.Cookies, nil
+		}
+	}
+
+	if ag.refresher != nil {
+		if warm, ok := ag.refresher.take(generateBasic.Client.GetID()); ok {
+			return warm.Token, warm.Cookies, nil
+		}
+	}
+
+	if isRefresh(generateBasic) {
+		if digiposteToken, cookies, ok := ag.renew(ctx, generateBasic.Client.GetID(), creds); ok {
+			return digiposteToken, cookies, nil
+		}
+	}
+
+	digiposteToken, cookies, err := ag.logins.login(ctx, creds)
 	if err != nil {
 		return nil, nil, fmt.Errorf("using %v: %w", ag.loginMethod, err)
 	}
@@ -96,6 +323,84 @@ func (ag *AccessGenerator) login(
 	return digiposteToken, cookies, nil
 }
 
+// isRefresh reports whether the token is generated by the refresh grant.
+// The manager passes the refreshed token information, which holds the refresh token.
+func isRefresh(generateBasic *oauth2v4.GenerateBasic) bool {
+	return generateBasic.TokenInfo != nil && generateBasic.TokenInfo.GetRefresh() != ""
+}
+
+// renew renews the Digiposte session from the stored cookies if the login method supports it.
+// It returns false if the session cannot be renewed, in which case a full login is required.
+func (ag *AccessGenerator) renew(
+	ctx context.Context,
+	clientID string,
+	creds *Credentials,
+) (*oauth2.Token, []*http.Cookie, bool) {
+	renewer, ok := ag.loginMethod.(SessionRenewer)
+	if !ok {
+		return nil, nil, false
+	}
+
+	cookies := ag.sessionCookies(clientID, creds)
+	if len(cookies) == 0 {
+		return nil, nil, false
+	}
+
+	digiposteToken, renewedCookies, err := ag.logins.renew(ctx, renewer, creds, cookies)
+	if err != nil {
+		ag.logger.Printf("Failed to renew the session of %q, falling back to login: %v", clientID, err)
+
+		return nil, nil, false
+	}
+
+	if len(renewedCookies) == 0 {
+		renewedCookies = cookies
+	}
+
+	return digiposteToken, renewedCookies, true
+}
+
+// persistCookies persists the cookies of the Digiposte account.
+// The cookies of the account configured under digiconfig.UsernameKey are also kept under digiconfig.CookiesKey,
+// where the configurations written before the cookies were kept per account expect them.
+func (ag *AccessGenerator) persistCookies(username string, cookies []*http.Cookie) error {
+	if err := digiconfig.SetAccountCookies(ag.setter, username, cookies); err != nil {
+		return fmt.Errorf("account: %w", err)
+	}
+
+	if username != digiconfig.Username(ag.getter) {
+		return nil
+	}
+
+	if err := digiconfig.SetCookies(ag.setter, cookies); err != nil {
+		return fmt.Errorf("default account: %w", err)
+	}
+
+	return nil
+}
+
+// sessionCookies returns the cookies of the last session of the client.
+// The cookies persisted for its account are used after a restart.
+func (ag *AccessGenerator) sessionCookies(clientID string, creds *Credentials) []*http.Cookie {
+	if value, ok := ag.sessions.Load(clientID); ok {
+		return value.(*session).Cookies //nolint:forcetypeassert
+	}
+
+	cookies, err := digiconfig.LoadAccountCookies(ag.getter, creds.Username)
+	if err == nil && len(cookies) == 0 && digiconfig.Username(ag.getter) == creds.Username {
+		// Persisted before the cookies were kept per account.
+		cookies, err = digiconfig.LoadCookies(ag.getter)
+	}
+
+	if err != nil {
+		ag.logger.Printf("Failed to load the persisted cookies: %v", err)
+
+		return nil
+	}
+
+	return cookies
+}
+
 type InvalidCredentialsError struct {
 	value interface{}
 }
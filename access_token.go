@@ -0,0 +1,50 @@
+package digipoauth
+
+import (
+	oauth2v4 "github.com/go-oauth2/oauth2/v4"
+)
+
+// jwtIDLength is the length of the random jti claim.
+const jwtIDLength = 16
+
+// AccessTokenClaims are the claims of the signed access tokens, as specified by RFC 9068.
+// They do not hold the Digiposte token, which stays on the server.
+type AccessTokenClaims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud,omitempty"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	ID        string `json:"jti"`
+}
+
+// accessTokenSigner issues signed JWT access tokens instead of handing out the Digiposte token.
+type accessTokenSigner struct {
+	keys   *keySet
+	issuer string
+}
+
+// accessToken signs the access token described by the token information.
+func (s *accessTokenSigner) accessToken(generateBasic *oauth2v4.GenerateBasic) (string, error) {
+	jti, err := randomString(jwtIDLength)
+	if err != nil {
+		return "", err
+	}
+
+	info := generateBasic.TokenInfo
+	createdAt := info.GetAccessCreateAt()
+
+	// The tokens are used by the clients on the endpoints of this server, such as the proxy.
+	return s.keys.sign(AccessTokenJWTType, &AccessTokenClaims{
+		Issuer:    s.issuer,
+		Subject:   generateBasic.UserID,
+		Audience:  s.issuer,
+		ClientID:  generateBasic.Client.GetID(),
+		Scope:     info.GetScope(),
+		ExpiresAt: createdAt.Add(info.GetAccessExpiresIn()).Unix(),
+		IssuedAt:  createdAt.Unix(),
+		ID:        jti,
+	})
+}
@@ -0,0 +1,363 @@
+package digipoauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminPath is the path to the admin API managing the registered clients.
+const AdminPath = "/admin/clients"
+
+// AdminConfig enables the admin API.
+// The secrets and credentials of the clients declared by the clients file are changed by editing the file instead.
+type AdminConfig struct {
+	// Token authenticates the requests to the admin API, sent as a bearer token.
+	Token string
+}
+
+// ErrUnknownClient is returned when managing a client that is not registered.
+var ErrUnknownClient = errors.New("unknown client")
+
+var (
+	errMissingAdminToken = errors.New("missing admin token")
+	errClientsFileClient = errors.New("the client is declared by the clients file, which must be edited instead")
+)
+
+// ClientSummary describes a registered client, without its secrets.
+type ClientSummary struct {
+	ID           string `json:"client_id"`
+	Domain       string `json:"domain,omitempty"`
+	Public       bool   `json:"public"`
+	PKCERequired bool   `json:"pkce_required"`
+	Disabled     bool   `json:"disabled"`
+	Username     string `json:"username,omitempty"`
+
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+	// AuthMethods are the methods the client may authenticate with.
+	AuthMethods []AuthMethod `json:"token_endpoint_auth_methods"`
+	// Scopes are the scopes the client may be granted.
+	Scopes []string `json:"scopes"`
+}
+
+// Clients lists the registered clients. The client store must be a ManagedClientStore.
+func (h *Handler) Clients() ([]*ClientSummary, error) {
+	clientStore, err := h.managedClientStore()
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := clientStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("list clients: %w", err)
+	}
+
+	summaries := make([]*ClientSummary, 0, len(infos))
+
+	for _, info := range infos {
+		client := toClient(info)
+
+		summary := &ClientSummary{
+			ID:           client.ID,
+			Domain:       client.Domain,
+			Public:       client.Public,
+			PKCERequired: client.PKCERequired,
+			Disabled:     client.Disabled,
+			Username:     "",
+			RedirectURIs: client.redirectURIs(),
+			AuthMethods:  client.AllowedAuthMethods(),
+			Scopes:       client.AllowedScopes(),
+		}
+
+		if creds, ok := h.accessGenerator.Credentials(client.ID); ok {
+			summary.Username = creds.Username
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+// RotateClientSecret replaces the secret of a confidential client with a random one, which is returned.
+// The clients declared by the clients file are rejected, as the file would restore their secret.
+func (h *Handler) RotateClientSecret(ctx context.Context, clientID string) (string, error) {
+	client, err := h.client(ctx, clientID)
+	if err != nil {
+		return "", err
+	}
+
+	if client.FromClientsFile {
+		return "", &InvalidClientError{ClientID: clientID, Err: errClientsFileClient}
+	}
+
+	if client.Public {
+		return "", &InvalidClientError{ClientID: clientID, Err: errPublicClientSecret}
+	}
+
+	secret, err := randomString(clientSecretLength)
+	if err != nil {
+		return "", fmt.Errorf("generate secret: %w", err)
+	}
+
+	if err := client.setSecret(secret, h.secretHashCost); err != nil {
+		return "", err
+	}
+
+	if err := h.clientStore.Set(clientID, client); err != nil {
+		return "", fmt.Errorf("set client: %w", err)
+	}
+
+	return secret, nil
+}
+
+// UpdateCredentials replaces the Digiposte credentials of the client. Empty fields are left unchanged.
+// The current Digiposte session is dropped, so that the next token is issued with the new credentials.
+// The clients declared by the clients file are rejected, as the file would restore their credentials.
+func (h *Handler) UpdateCredentials(ctx context.Context, clientID string, update *Credentials) error {
+	client, err := h.client(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	if client.FromClientsFile {
+		return &InvalidClientError{ClientID: clientID, Err: errClientsFileClient}
+	}
+
+	creds := &Credentials{
+		Username:  "",
+		Password:  "",
+		OTPSecret: "",
+	}
+
+	if current, ok := h.accessGenerator.Credentials(clientID); ok {
+		*creds = *current
+	}
+
+	if update.Username != "" {
+		creds.Username = update.Username
+	}
+
+	if update.Password != "" {
+		creds.Password = update.Password
+	}
+
+	if update.OTPSecret != "" {
+		creds.OTPSecret = update.OTPSecret
+	}
+
+	h.accessGenerator.SetCredentials(clientID, creds)
+	h.accessGenerator.forgetSession(clientID)
+
+	return nil
+}
+
+// SetClientDisabled disables or enables the client. Disabled clients are rejected by all the endpoints.
+// Disabling the client revokes its tokens: they are not accepted again once it is enabled.
+func (h *Handler) SetClientDisabled(ctx context.Context, clientID string, disabled bool) error {
+	client, err := h.client(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	client.Disabled = disabled
+
+	if disabled {
+		client.TokensNotBefore = time.Now()
+	}
+
+	if err := h.clientStore.Set(clientID, client); err != nil {
+		return fmt.Errorf("set client: %w", err)
+	}
+
+	if disabled {
+		h.accessGenerator.forgetSession(clientID)
+	}
+
+	return nil
+}
+
+// DeleteClient removes the client and its Digiposte credentials. The client store must be a ManagedClientStore.
+// The tokens of the client are rejected by all the endpoints once it is deleted.
+func (h *Handler) DeleteClient(ctx context.Context, clientID string) error {
+	clientStore, err := h.managedClientStore()
+	if err != nil {
+		return err
+	}
+
+	if _, err := h.client(ctx, clientID); err != nil {
+		return err
+	}
+
+	if err := clientStore.Delete(clientID); err != nil {
+		return fmt.Errorf("delete client: %w", err)
+	}
+
+	h.accessGenerator.forget(clientID)
+
+	if h.consent != nil {
+		if err := h.consent.decisions.forget(clientID); err != nil {
+			return fmt.Errorf("forget consent: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) managedClientStore() (ManagedClientStore, error) { //nolint:ireturn
+	clientStore, ok := h.clientStore.(ManagedClientStore)
+	if !ok {
+		return nil, ErrUnmanagedClientStore
+	}
+
+	return clientStore, nil
+}
+
+func (h *Handler) client(ctx context.Context, clientID string) (*Client, error) {
+	info, err := h.clientStore.GetByID(ctx, clientID)
+	if err != nil {
+		return nil, fmt.Errorf("get client: %w", err)
+	}
+
+	if info == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownClient, clientID)
+	}
+
+	return toClient(info), nil
+}
+
+const clientSecretLength = 32
+
+// adminError is the body of the error responses of the admin API.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// adminCredentials is the body of the requests updating the Digiposte credentials of a client.
+type adminCredentials struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	OTPSecret string `json:"otp_secret"`
+}
+
+// adminSecret is the body of the response to a secret rotation.
+type adminSecret struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// newAdminHandler serves the admin API:
+//
+//	GET    /admin/clients                       lists the clients
+//	POST   /admin/clients/{id}/secret           rotates the secret
+//	PUT    /admin/clients/{id}/credentials      updates the Digiposte credentials
+//	POST   /admin/clients/{id}/disable|enable   disables or enables the client
+//	DELETE /admin/clients/{id}                  deletes the client
+func (h *Handler) newAdminHandler(config *AdminConfig) (http.Handler, error) {
+	if config.Token == "" {
+		return nil, &InvalidOptionError{Name: "Admin", Err: errMissingAdminToken}
+	}
+
+	if _, err := h.managedClientStore(); err != nil {
+		return nil, &InvalidOptionError{Name: "Admin", Err: err}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+
+		if !strings.HasPrefix(authorization, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, &adminError{Error: http.StatusText(http.StatusUnauthorized)})
+
+			return
+		}
+
+		h.serveAdmin(w, r)
+	}), nil
+}
+
+func (h *Handler) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, AdminPath), "/")
+
+	if path == "" {
+		if r.Method != http.MethodGet {
+			writeAdminMethodNotAllowed(w, http.MethodGet)
+
+			return
+		}
+
+		clients, err := h.Clients()
+		writeAdminResponse(w, clients, err)
+
+		return
+	}
+
+	clientID, action, _ := strings.Cut(path, "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		writeAdminResponse(w, nil, h.DeleteClient(r.Context(), clientID))
+
+	case action == "secret" && r.Method == http.MethodPost:
+		secret, err := h.RotateClientSecret(r.Context(), clientID)
+		writeAdminResponse(w, &adminSecret{ClientID: clientID, ClientSecret: secret}, err)
+
+	case action == "credentials" && r.Method == http.MethodPut:
+		var body adminCredentials
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, &adminError{Error: fmt.Sprintf("decode body: %v", err)})
+
+			return
+		}
+
+		writeAdminResponse(w, nil, h.UpdateCredentials(r.Context(), clientID, &Credentials{
+			Username:  body.Username,
+			Password:  body.Password,
+			OTPSecret: body.OTPSecret,
+		}))
+
+	case (action == "disable" || action == "enable") && r.Method == http.MethodPost:
+		writeAdminResponse(w, nil, h.SetClientDisabled(r.Context(), clientID, action == "disable"))
+
+	case action == "":
+		writeAdminMethodNotAllowed(w, http.MethodDelete)
+
+	case action == "credentials":
+		writeAdminMethodNotAllowed(w, http.MethodPut)
+
+	case action == "secret" || action == "disable" || action == "enable":
+		writeAdminMethodNotAllowed(w, http.MethodPost)
+
+	default:
+		writeJSON(w, http.StatusNotFound, &adminError{Error: http.StatusText(http.StatusNotFound)})
+	}
+}
+
+func writeAdminResponse(w http.ResponseWriter, value interface{}, err error) {
+	var invalidClientErr *InvalidClientError
+
+	switch {
+	case errors.Is(err, ErrUnknownClient):
+		writeJSON(w, http.StatusNotFound, &adminError{Error: err.Error()})
+	case errors.As(err, &invalidClientErr):
+		writeJSON(w, http.StatusBadRequest, &adminError{Error: err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, &adminError{Error: err.Error()})
+	case value == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusOK, value)
+	}
+}
+
+func writeAdminMethodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeJSON(w, http.StatusMethodNotAllowed, &adminError{Error: http.StatusText(http.StatusMethodNotAllowed)})
+}
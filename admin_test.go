@@ -0,0 +1,257 @@
+package digipoauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4/server"
+	"github.com/go-oauth2/oauth2/v4/store"
+	digipoauth "github.com/holyhope/digiposte-oauth"
+	configfakes "github.com/holyhope/digiposte-oauth/config/configfakes"
+	. "github.com/onsi/ginkgo/v2" //nolint:revive
+	. "github.com/onsi/gomega"    //nolint:revive
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+const AdminToken = "admin-token"
+
+var _ = Describe("Admin API", func() {
+	var (
+		handler    *digipoauth.Handler
+		hostServer *httptest.Server
+		logins     []*digipoauth.Credentials
+	)
+
+	BeforeEach(func() {
+		logins = nil
+
+		var err error
+
+		handler, err = digipoauth.NewHandler(&configfakes.FakeSetter{}, &digipoauth.Config{
+			Server: server.NewConfig(),
+			Issuer: "http://localhost",
+			Admin:  &digipoauth.AdminConfig{Token: AdminToken},
+			// Keeps the tests fast.
+			SecretHashCost: bcrypt.MinCost,
+			LoginMethod: digipoauth.LoginMethodFunc(
+				func(_ context.Context, creds *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+					logins = append(logins, creds)
+
+					return &oauth2.Token{
+						AccessToken:  "access-token",
+						TokenType:    "token-type",
+						RefreshToken: "",
+						Expiry:       time.Now().Add(time.Hour),
+					}, nil, nil
+				},
+			),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(handler.Close)
+
+		hostServer = httptest.NewServer(handler)
+		DeferCleanup(hostServer.Close)
+
+		Expect(handler.RegisterUser(
+			ClientID, ClientSecret, hostServer.URL,
+			Username, Password, OTPSecret,
+		)).To(Succeed())
+	})
+
+	call := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, hostServer.URL+digipoauth.AdminPath+path, strings.NewReader(body)) //nolint:noctx
+		Expect(err).ToNot(HaveOccurred())
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(resp.Body.Close)
+
+		return resp
+	}
+
+	exchange := func(ctx context.Context, secret string) (*oauth2.Token, error) {
+		var code string
+
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, _ []*http.Request) error {
+				code = req.URL.Query().Get("code")
+
+				return http.ErrUseLastResponse
+			},
+		}
+
+		cfg := &oauth2.Config{
+			ClientID:     ClientID,
+			ClientSecret: secret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:       hostServer.URL + digipoauth.AuthorizePath,
+				TokenURL:      hostServer.URL + digipoauth.TokenPath,
+				AuthStyle:     oauth2.AuthStyleInParams,
+				DeviceAuthURL: "",
+			},
+			RedirectURL: hostServer.URL,
+			Scopes:      nil,
+		}
+
+		resp, err := client.Get(cfg.AuthCodeURL("tests")) //nolint:noctx
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Body.Close()).To(Succeed())
+
+		if code == "" {
+			return nil, &oauth2.RetrieveError{Response: resp, Body: nil, ErrorCode: "", ErrorDescription: "", ErrorURI: ""}
+		}
+
+		return cfg.Exchange(ctx, code)
+	}
+
+	// refresh renews the token, once expired, through the refresh token grant.
+	refresh := func(ctx context.Context, token *oauth2.Token) error {
+		token.Expiry = time.Now().Add(-time.Minute)
+
+		_, err := (&oauth2.Config{
+			ClientID:     ClientID,
+			ClientSecret: ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:       "",
+				TokenURL:      hostServer.URL + digipoauth.TokenPath,
+				AuthStyle:     oauth2.AuthStyleInParams,
+				DeviceAuthURL: "",
+			},
+			RedirectURL: hostServer.URL,
+			Scopes:      nil,
+		}).TokenSource(ctx, token).Token()
+
+		return err
+	}
+
+	It("Should reject requests without the admin token", func() {
+		Expect(call(http.MethodGet, "", "", "").StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(call(http.MethodGet, "", "wrong", "").StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("Should require the bearer scheme", func() {
+		req, err := http.NewRequest(http.MethodGet, hostServer.URL+digipoauth.AdminPath, nil) //nolint:noctx
+		Expect(err).ToNot(HaveOccurred())
+
+		req.Header.Set("Authorization", AdminToken)
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("Should list the clients without their secrets", func() {
+		resp := call(http.MethodGet, "", AdminToken, "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var clients []*digipoauth.ClientSummary
+		Expect(json.NewDecoder(resp.Body).Decode(&clients)).To(Succeed())
+		Expect(clients).To(ConsistOf(&digipoauth.ClientSummary{
+			ID:           ClientID,
+			Domain:       hostServer.URL,
+			Public:       false,
+			PKCERequired: false,
+			Disabled:     false,
+			Username:     Username,
+			RedirectURIs: []string{hostServer.URL},
+			AuthMethods: []digipoauth.AuthMethod{
+				digipoauth.AuthMethodClientSecretBasic,
+				digipoauth.AuthMethodClientSecretPost,
+			},
+			Scopes: digipoauth.SupportedScopes,
+		}))
+	})
+
+	It("Should rotate the client secret", func(ctx SpecContext) {
+		resp := call(http.MethodPost, "/"+ClientID+"/secret", AdminToken, "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var body map[string]string
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		Expect(body["client_secret"]).ToNot(BeEmpty())
+
+		_, err := exchange(ctx, ClientSecret)
+		Expect(err).To(HaveOccurred())
+
+		_, err = exchange(ctx, body["client_secret"])
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Should update the Digiposte credentials", func(ctx SpecContext) {
+		resp := call(http.MethodPut, "/"+ClientID+"/credentials", AdminToken, `{"password":"new-password"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+		_, err := exchange(ctx, ClientSecret)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(logins).To(Equal([]*digipoauth.Credentials{{
+			Username:  Username,
+			Password:  "new-password",
+			OTPSecret: OTPSecret,
+		}}))
+	})
+
+	It("Should disable and enable the client", func(ctx SpecContext) {
+		Expect(call(http.MethodPost, "/"+ClientID+"/disable", AdminToken, "").StatusCode).To(Equal(http.StatusNoContent))
+
+		_, err := exchange(ctx, ClientSecret)
+		Expect(err).To(HaveOccurred())
+
+		Expect(handler.SetClientDisabled(ctx, ClientID, false)).To(Succeed())
+
+		_, err = exchange(ctx, ClientSecret)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Should revoke the tokens of a disabled client", func(ctx SpecContext) {
+		token, err := exchange(ctx, ClientSecret)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(handler.SetClientDisabled(ctx, ClientID, true)).To(Succeed())
+		Expect(handler.SetClientDisabled(ctx, ClientID, false)).To(Succeed())
+
+		Expect(refresh(ctx, token)).To(MatchError(ContainSubstring("invalid_grant")))
+	})
+
+	It("Should require a client store which can list and delete the clients", func() {
+		_, err := digipoauth.NewHandler(&configfakes.FakeSetter{}, &digipoauth.Config{
+			Server:      server.NewConfig(),
+			Issuer:      "http://localhost",
+			Admin:       &digipoauth.AdminConfig{Token: AdminToken},
+			ClientStore: store.NewClientStore(),
+		})
+		Expect(err).To(MatchError(digipoauth.ErrUnmanagedClientStore))
+	})
+
+	It("Should delete the client", func(ctx SpecContext) {
+		Expect(call(http.MethodDelete, "/"+ClientID, AdminToken, "").StatusCode).To(Equal(http.StatusNoContent))
+		Expect(call(http.MethodDelete, "/"+ClientID, AdminToken, "").StatusCode).To(Equal(http.StatusNotFound))
+
+		Expect(handler.Clients()).To(BeEmpty())
+
+		_, err := exchange(ctx, ClientSecret)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should not revive the tokens of a deleted client registered again", func(ctx SpecContext) {
+		token, err := exchange(ctx, ClientSecret)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(handler.DeleteClient(ctx, ClientID)).To(Succeed())
+		Expect(handler.RegisterUser(
+			ClientID, ClientSecret, hostServer.URL,
+			Username, Password, OTPSecret,
+		)).To(Succeed())
+
+		Expect(refresh(ctx, token)).To(MatchError(ContainSubstring("invalid_grant")))
+	})
+})
@@ -0,0 +1,412 @@
+package digipoauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
+)
+
+// AuditAction is the operation recorded by an audit event.
+type AuditAction string
+
+const (
+	// AuditActionAuthorize is a request to the authorize endpoint.
+	AuditActionAuthorize AuditAction = "authorize"
+	// AuditActionCodeExchange is the exchange of an authorization code on the token endpoint.
+	AuditActionCodeExchange AuditAction = "code_exchange"
+	// AuditActionRefresh is the refresh of a token on the token endpoint.
+	AuditActionRefresh AuditAction = "refresh"
+	// AuditActionToken is a request to the token endpoint with any other grant, such as the device code.
+	AuditActionToken AuditAction = "token"
+	// AuditActionRevocation is a request to the revocation endpoint.
+	AuditActionRevocation AuditAction = "revocation"
+	// AuditActionDeviceAuthorization is a request to the device authorization endpoint.
+	AuditActionDeviceAuthorization AuditAction = "device_authorization"
+	// AuditActionDeviceVerification is a request to the device verification page, such as a decision of the operator.
+	AuditActionDeviceVerification AuditAction = "device_verification"
+	// AuditActionLogin is a call of the LoginMethod.
+	AuditActionLogin AuditAction = "login"
+	// AuditActionRenew is a call of the SessionRenewer, renewing the Digiposte session from its cookies.
+	AuditActionRenew AuditAction = "renew"
+)
+
+// AuditOutcome is the result of an audited operation.
+type AuditOutcome string
+
+const (
+	// AuditOutcomeSuccess is an operation which succeeded, such as an issued code or token.
+	AuditOutcomeSuccess AuditOutcome = "success"
+	// AuditOutcomeDenied is an authorization denied by the user.
+	AuditOutcomeDenied AuditOutcome = "denied"
+	// AuditOutcomePending is an operation waiting for the user, such as a consent page or a device polling.
+	AuditOutcomePending AuditOutcome = "pending"
+	// AuditOutcomeFailure is an operation which failed.
+	AuditOutcomeFailure AuditOutcome = "failure"
+)
+
+// AuditEvent is a record of the audit log.
+// It never holds secrets: neither the tokens, the codes, the client secrets nor the Digiposte password.
+type AuditEvent struct {
+	Time     time.Time    `json:"time"`
+	Action   AuditAction  `json:"action"`
+	Outcome  AuditOutcome `json:"outcome"`
+	ClientID string       `json:"client_id,omitempty"`
+	// Username is the Digiposte account of the client.
+	Username   string `json:"username,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	GrantType  string `json:"grant_type,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+	Status     int    `json:"status,omitempty"`
+	// Error is the class of the error, such as an OAuth error code, never its message.
+	Error string `json:"error,omitempty"`
+	// DurationMS is the duration of the operation in milliseconds.
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// AuditSink receives the events of the audit log. It must be safe for concurrent use.
+type AuditSink interface {
+	Record(event *AuditEvent) error
+}
+
+// AuditSinkFunc is an AuditSink function.
+type AuditSinkFunc func(event *AuditEvent) error
+
+func (f AuditSinkFunc) Record(event *AuditEvent) error {
+	return f(event)
+}
+
+// AuditConfig enables the audit log.
+type AuditConfig struct {
+	// Path is the file to which the events are appended as JSON lines.
+	Path string
+	// Sink receives the events instead of the file at Path.
+	Sink AuditSink
+}
+
+var errMissingAuditSink = errors.New("either a path or a sink is required")
+
+// JSONLinesAuditSink writes each event as a line of JSON.
+type JSONLinesAuditSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+var _ AuditSink = (*JSONLinesAuditSink)(nil)
+
+// NewJSONLinesAuditSink writes the events to the writer, such as a file opened for appending.
+func NewJSONLinesAuditSink(writer io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{
+		mutex:  sync.Mutex{},
+		writer: writer,
+	}
+}
+
+func (s *JSONLinesAuditSink) Record(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// A single write keeps the lines whole when several processes append to the same file.
+	if _, err := s.writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write event: %w", err)
+	}
+
+	return nil
+}
+
+// auditLog records the events to the sink. It is disabled when nil.
+type auditLog struct {
+	sink   AuditSink
+	file   *os.File
+	logger *log.Logger
+	now    func() time.Time
+}
+
+func newAuditLog(config *AuditConfig, logger *log.Logger) (*auditLog, error) {
+	if config == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	audit := &auditLog{
+		sink:   config.Sink,
+		file:   nil,
+		logger: logger,
+		now:    time.Now,
+	}
+
+	if audit.sink != nil {
+		return audit, nil
+	}
+
+	if config.Path == "" {
+		return nil, errMissingAuditSink
+	}
+
+	file, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600) //nolint:gomnd
+	if err != nil {
+		return nil, fmt.Errorf("open %q: %w", config.Path, err)
+	}
+
+	audit.file = file
+	audit.sink = NewJSONLinesAuditSink(file)
+
+	return audit, nil
+}
+
+// record sends the event, timed from start, to the sink. A failure is only logged.
+func (a *auditLog) record(event *AuditEvent, start time.Time) {
+	if a == nil {
+		return
+	}
+
+	event.Time = a.now()
+	event.DurationMS = float64(event.Time.Sub(start)) / float64(time.Millisecond)
+
+	if err := a.sink.Record(event); err != nil {
+		a.logger.Printf("Failed to record the %s audit event of %q: %v", event.Action, event.ClientID, err)
+	}
+}
+
+// recordLogin records the outcome of a call of the LoginMethod, or of the SessionRenewer.
+func (a *auditLog) recordLogin(action AuditAction, creds *Credentials, start time.Time, err error) {
+	if a == nil {
+		return
+	}
+
+	event := &AuditEvent{
+		Time:       time.Time{},
+		Action:     action,
+		Outcome:    AuditOutcomeSuccess,
+		ClientID:   "",
+		Username:   creds.Username,
+		RemoteAddr: "",
+		GrantType:  "",
+		Scope:      "",
+		Status:     0,
+		Error:      "",
+		DurationMS: 0,
+	}
+
+	if err != nil {
+		event.Outcome = AuditOutcomeFailure
+		event.Error = loginErrorClass(err)
+	}
+
+	a.record(event, start)
+}
+
+func (a *auditLog) close() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+
+	return a.file.Close() //nolint:wrapcheck
+}
+
+// loginErrorClass classifies the error of a login, whose message may tell too much about the account.
+func loginErrorClass(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+
+	var requiredField *RequiredFieldError
+	if errors.Is(err, ErrNilCredentials) || errors.As(err, &requiredField) {
+		return "invalid_credentials"
+	}
+
+	return "login_failed"
+}
+
+// audit records the outcome of the requests to an oauth endpoint.
+func (e *endpoints) audit(action AuditAction, next http.HandlerFunc) http.HandlerFunc {
+	if e.auditLog == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &auditRecorder{ResponseWriter: w, status: 0, location: "", body: nil}
+
+		next(recorder, r)
+
+		event := &AuditEvent{
+			Time:       time.Time{},
+			Action:     action,
+			Outcome:    AuditOutcomeSuccess,
+			ClientID:   requestClientID(r),
+			Username:   "",
+			RemoteAddr: r.RemoteAddr,
+			GrantType:  "",
+			Scope:      "",
+			Status:     recorder.status,
+			Error:      recorder.errorCode(),
+			DurationMS: 0,
+		}
+
+		switch action {
+		case AuditActionAuthorize, AuditActionDeviceAuthorization:
+			event.Scope = r.Form.Get("scope")
+		case AuditActionDeviceVerification:
+			// The operator only enters the user code of the device.
+			event.ClientID = e.deviceGrants.clientID(r.Form.Get("user_code"))
+		default:
+			event.GrantType = r.Form.Get("grant_type")
+			event.Action = tokenAuditAction(action, event.GrantType)
+		}
+
+		if creds, ok := e.accessGenerator.Credentials(event.ClientID); ok {
+			event.Username = creds.Username
+		}
+
+		event.Outcome = auditOutcome(action, recorder.status, event.Error)
+		if action == AuditActionDeviceVerification && event.Outcome == AuditOutcomeSuccess {
+			event.Outcome = deviceVerificationOutcome(r)
+		}
+
+		e.auditLog.record(event, start)
+	}
+}
+
+// tokenAuditAction names the requests to the token endpoint after their grant.
+func tokenAuditAction(action AuditAction, grantType string) AuditAction {
+	if action != AuditActionToken {
+		return action
+	}
+
+	switch grantType {
+	case "authorization_code":
+		return AuditActionCodeExchange
+	case "refresh_token":
+		return AuditActionRefresh
+	}
+
+	return AuditActionToken
+}
+
+func auditOutcome(action AuditAction, status int, errorCode string) AuditOutcome {
+	switch {
+	case errorCode == oautherrs.ErrAccessDenied.Error():
+		return AuditOutcomeDenied
+	case errorCode == errAuthorizationPending.Error() || errorCode == errSlowDown.Error():
+		return AuditOutcomePending
+	case errorCode != "" || status >= http.StatusBadRequest:
+		return AuditOutcomeFailure
+	case action == AuditActionAuthorize && status == http.StatusOK:
+		// The consent page waits for the decision of the user.
+		return AuditOutcomePending
+	}
+
+	return AuditOutcomeSuccess
+}
+
+// deviceVerificationOutcome tells the decision of the operator on the device verification page.
+func deviceVerificationOutcome(r *http.Request) AuditOutcome {
+	switch {
+	case r.Method != http.MethodPost || r.PostForm.Get("action") == "":
+		// The page waits for the user code or for the decision.
+		return AuditOutcomePending
+	case r.PostForm.Get("action") == "approve":
+		return AuditOutcomeSuccess
+	}
+
+	return AuditOutcomeDenied
+}
+
+// requestClientID returns the client identified by the request, authenticated or not.
+func requestClientID(r *http.Request) string {
+	if clientID := r.FormValue("client_id"); clientID != "" {
+		return clientID
+	}
+
+	if username, _, ok := r.BasicAuth(); ok {
+		if clientID, err := url.QueryUnescape(username); err == nil {
+			return clientID
+		}
+	}
+
+	return ""
+}
+
+// maxAuditErrorBody is the size of the error responses read to find their OAuth error code.
+const maxAuditErrorBody = 4096
+
+// auditRecorder records the status of a response and the OAuth error it reports, in its body or redirection.
+// The bodies of the successful responses, which hold the tokens, are not kept.
+type auditRecorder struct {
+	http.ResponseWriter
+
+	status   int
+	location string
+	body     []byte
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.location = r.Header().Get("Location")
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	if remaining := maxAuditErrorBody - len(r.body); r.status >= http.StatusBadRequest && remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+
+		r.body = append(r.body, data[:remaining]...)
+	}
+
+	return r.ResponseWriter.Write(data) //nolint:wrapcheck
+}
+
+// errorCode returns the OAuth error code of the response, if any.
+func (r *auditRecorder) errorCode() string {
+	if r.location != "" {
+		location, err := url.Parse(r.location)
+		if err != nil {
+			return ""
+		}
+
+		// The implicit grant returns the error in the fragment.
+		if code := location.Query().Get("error"); code != "" {
+			return code
+		}
+
+		fragment, _ := url.ParseQuery(location.Fragment)
+
+		return fragment.Get("error")
+	}
+
+	var response struct {
+		Error string `json:"error"`
+	}
+
+	if len(r.body) > 0 && json.Unmarshal(r.body, &response) == nil {
+		return response.Error
+	}
+
+	return ""
+}
@@ -56,32 +56,39 @@ func WithCancelOnClose(ctx context.Context, done <-chan struct{}) (context.Conte
 func (c *chromeLogin) resolveLogin(
 	ctx context.Context,
 	creds *digioauth.Credentials,
+) (*oauth2.Token, []*http.Cookie, error) {
+	return c.resolveUntilFinalScreen(ctx,
+		&privacyScreen{
+			AcceptCookies: false,
+		},
+		&credentialsScreen{
+			Username: creds.Username,
+			Password: creds.Password,
+		},
+		&otpScreen{
+			Secret: creds.OTPSecret,
+		},
+		&trustedDeviceScreen{},
+	)
+}
+
+// resolveUntilFinalScreen resolves the screens until the final screen returns the token.
+func (c *chromeLogin) resolveUntilFinalScreen(
+	ctx context.Context,
+	screens ...Screen,
 ) (*oauth2.Token, []*http.Cookie, error) {
 	finalScreen := &finalScreen{
 		Token:   nil,
 		Cookies: nil,
 	}
 
-	screens := Screens{
-		screens: []Screen{
-			&privacyScreen{
-				AcceptCookies: false,
-			},
-			&credentialsScreen{
-				Username: creds.Username,
-				Password: creds.Password,
-			},
-			&otpScreen{
-				Secret: creds.OTPSecret,
-			},
-			&trustedDeviceScreen{},
-			finalScreen,
-		},
+	resolvers := Screens{
+		screens:          append(screens, finalScreen),
 		refreshFrequency: c.refreshFrequency,
 		succeeded:        atomic.Bool{},
 	}
 
-	go screens.Resolve(ctx)
+	go resolvers.Resolve(ctx)
 
 	ticker := time.NewTicker(c.refreshFrequency)
 	defer ticker.Stop()
@@ -93,7 +100,7 @@ func (c *chromeLogin) resolveLogin(
 
 		case <-ticker.C:
 			if finalScreen.Token != nil {
-				screens.succeeded.Store(true)
+				resolvers.succeeded.Store(true)
 
 				return finalScreen.Token, finalScreen.Cookies, nil
 			}
@@ -109,6 +116,7 @@ type chromeLogin struct {
 	screenShortOnError bool
 	refreshFrequency   time.Duration
 	timeout            time.Duration
+	renewTimeout       time.Duration
 
 	infoLogger  *log.Logger
 	errorLogger *log.Logger
@@ -34,7 +34,10 @@ type chromeMethod struct {
 	opts []digioauth.Option
 }
 
-var _ digioauth.LoginMethod = (*chromeMethod)(nil)
+var (
+	_ digioauth.LoginMethod    = (*chromeMethod)(nil)
+	_ digioauth.SessionRenewer = (*chromeMethod)(nil)
+)
 
 // Login logs in to digiposte using chrome.
 func (c *chromeMethod) Login(ctx context.Context, creds *digioauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
@@ -58,6 +61,29 @@ func (c *chromeMethod) Login(ctx context.Context, creds *digioauth.Credentials)
 	return chrome.login(ctx, independentChromeCtx, creds)
 }
 
+// Renew renews a digiposte session using chrome, starting from the cookies of a previous login.
+// Credentials are not submitted, so it fails if the cookies are no longer valid.
+func (c *chromeMethod) Renew(
+	ctx context.Context,
+	_ *digioauth.Credentials,
+	cookies []*http.Cookie,
+) (*oauth2.Token, []*http.Cookie, error) {
+	independentChromeCtx, chrome, cancel, err := c.newChromeLogin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("new chrome login: %w", err)
+	}
+
+	defer cancel()
+
+	if err := chromedp.Run(independentChromeCtx); err != nil {
+		return nil, nil, fmt.Errorf("init: %w", err)
+	}
+
+	defer closeChrome(independentChromeCtx)
+
+	return chrome.renew(ctx, independentChromeCtx, cookies)
+}
+
 func (c *chromeMethod) String() string {
 	return "chrome"
 }
@@ -65,6 +91,8 @@ func (c *chromeMethod) String() string {
 const (
 	// DefaultRefreshFrequency is the default refresh frequency for the login process.
 	DefaultRefreshFrequency = 1500 * time.Millisecond
+	// DefaultRenewTimeout is the default timeout to renew a session from cookies.
+	DefaultRenewTimeout = 30 * time.Second
 )
 
 func (c *chromeMethod) newChromeLogin(
@@ -78,6 +106,7 @@ func (c *chromeMethod) newChromeLogin(
 		infoLogger:         log.Default(),
 		errorLogger:        log.Default(),
 		timeout:            0,
+		renewTimeout:       DefaultRenewTimeout,
 	}
 
 	for i, opt := range c.opts {
@@ -191,3 +191,28 @@ func (o *WithLoggers) Apply(instance interface{}) error {
 
 	return &InvalidTypeOptionError{instance: instance}
 }
+
+type WithRenewTimeout struct {
+	Timeout time.Duration
+}
+
+func (o *WithRenewTimeout) Apply(instance interface{}) error {
+	if chrome, ok := instance.(*chromeLogin); ok {
+		chrome.renewTimeout = o.Timeout
+
+		return nil
+	}
+
+	return &InvalidTypeOptionError{instance: instance}
+}
+
+func (o *WithRenewTimeout) Validate() error {
+	if o.Timeout <= 0 {
+		return &digioauth.InvalidOptionError{
+			Name: "WithRenewTimeout",
+			Err:  errNegativeTimeout,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package chrome
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"golang.org/x/oauth2"
+)
+
+func (c *chromeLogin) renew( //nolint:nonamedreturns
+	parentCtx, independentChromeCtx context.Context,
+	cookies []*http.Cookie,
+) (_ *oauth2.Token, _ []*http.Cookie, finalErr error) {
+	if c.renewTimeout > 0 {
+		ctx, cancel := context.WithTimeout(parentCtx, c.renewTimeout)
+		defer cancel()
+
+		parentCtx = ctx
+	}
+
+	ctx, cancel := WithCancelOnClose(independentChromeCtx, parentCtx.Done())
+	defer cancel()
+
+	defer c.ScreenshotIfNeeded(independentChromeCtx, &finalErr)
+
+	if err := chromedp.Run(ctx, injectCookies(cookies)); err != nil {
+		return nil, nil, fmt.Errorf("inject cookies: %w", err)
+	}
+
+	infoLogger(ctx).Printf("%d cookies injected\n", len(cookies))
+
+	if err := resolve(ctx, &firstScreen{
+		URL: c.url,
+	}); err != nil {
+		return nil, nil, fmt.Errorf("first screen: %w", err)
+	}
+
+	infoLogger(ctx).Printf("Page %q loaded\n", c.url)
+
+	return c.resolveUntilFinalScreen(ctx,
+		&privacyScreen{
+			AcceptCookies: false,
+		},
+	)
+}
+
+func injectCookies(cookies []*http.Cookie) chromedp.Action {
+	params := make([]*network.CookieParam, 0, len(cookies))
+
+	for _, cookie := range cookies {
+		params = append(params, chromeCookie(cookie))
+	}
+
+	return network.SetCookies(params)
+}
+
+func chromeCookie(cookie *http.Cookie) *network.CookieParam {
+	var sameSite network.CookieSameSite
+
+	switch cookie.SameSite {
+	case http.SameSiteLaxMode:
+		sameSite = network.CookieSameSiteLax
+	case http.SameSiteStrictMode:
+		sameSite = network.CookieSameSiteStrict
+	case http.SameSiteNoneMode:
+		sameSite = network.CookieSameSiteNone
+	case http.SameSiteDefaultMode:
+		sameSite = ""
+	}
+
+	var expires *cdp.TimeSinceEpoch
+
+	// Session cookies have no expiry.
+	if !cookie.Expires.IsZero() && cookie.Expires.Unix() > 0 {
+		expiry := cdp.TimeSinceEpoch(cookie.Expires)
+		expires = &expiry
+	}
+
+	return &network.CookieParam{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Domain:   cookie.Domain,
+		Path:     cookie.Path,
+		Secure:   cookie.Secure,
+		HTTPOnly: cookie.HttpOnly,
+		SameSite: sameSite,
+		Expires:  expires,
+
+		URL:          "",
+		Priority:     "",
+		SameParty:    false,
+		SourceScheme: "",
+		SourcePort:   0,
+		PartitionKey: "",
+	}
+}
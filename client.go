@@ -0,0 +1,491 @@
+package digipoauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
+	digiconfig "github.com/holyhope/digiposte-oauth/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Client is a client registered to the server.
+type Client struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	Public bool   `json:"public,omitempty"`
+	UserID string `json:"user_id,omitempty"`
+
+	// SecretHash is the bcrypt hash of the secret. It is used instead of Secret when set.
+	// Secret is only kept in plain text by stores written before the secrets were hashed,
+	// until the client authenticates with it.
+	SecretHash string `json:"secret_hash,omitempty"`
+	// RedirectURIs are the redirect URIs allowed for the client. Domain is the first one.
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+
+	// APIURL and DocumentURL override the Digiposte URLs of the configuration for this client.
+	APIURL      string `json:"api_url,omitempty"`
+	DocumentURL string `json:"document_url,omitempty"`
+
+	// PKCERequired rejects authorization requests without a code_challenge.
+	PKCERequired bool `json:"pkce_required,omitempty"`
+	// Disabled rejects the client until it is enabled again.
+	Disabled bool `json:"disabled,omitempty"`
+	// TokensNotBefore rejects the tokens issued earlier, such as those issued before the client was disabled.
+	TokensNotBefore time.Time `json:"tokens_not_before"`
+	// FromClientsFile marks the clients declared by the clients file, which are deleted once removed from it.
+	FromClientsFile bool `json:"from_clients_file,omitempty"`
+
+	// AuthMethods are the methods the client may authenticate with. See Client.AllowedAuthMethods for the defaults.
+	AuthMethods []AuthMethod `json:"auth_methods,omitempty"`
+	// PublicKeys are the PEM encoded public keys verifying the assertions of the private_key_jwt method.
+	PublicKeys []string `json:"public_keys,omitempty"`
+	// Scopes restricts the scopes the client may be granted. See Client.AllowedScopes for the default.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+var (
+	_ oauth2.ClientInfo             = (*Client)(nil)
+	_ oauth2.ClientPasswordVerifier = (*Client)(nil)
+)
+
+func (c *Client) GetID() string {
+	return c.ID
+}
+
+func (c *Client) GetSecret() string {
+	return c.Secret
+}
+
+func (c *Client) GetDomain() string {
+	return c.Domain
+}
+
+func (c *Client) IsPublic() bool {
+	return c.Public
+}
+
+func (c *Client) GetUserID() string {
+	return c.UserID
+}
+
+// redirectURIs returns the registered redirect URIs.
+// Clients stored before the list was introduced only have their domain.
+func (c *Client) redirectURIs() []string {
+	if len(c.RedirectURIs) == 0 && c.Domain != "" {
+		return []string{c.Domain}
+	}
+
+	return c.RedirectURIs
+}
+
+// AllowsRedirectURI reports whether the redirect URI exactly matches one of the registered ones.
+// As specified by RFC 8252, the port of loopback redirect URIs is ignored, for native apps listening on a random port.
+func (c *Client) AllowsRedirectURI(redirectURI string) bool {
+	for _, registered := range c.redirectURIs() {
+		if registered == redirectURI || matchesLoopback(registered, redirectURI) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesLoopback reports whether both URIs are the same http loopback URI, regardless of the port.
+func matchesLoopback(registered, redirectURI string) bool {
+	registeredURL, err := url.Parse(registered)
+	if err != nil || registeredURL.Scheme != "http" || !isLoopback(registeredURL.Hostname()) {
+		return false
+	}
+
+	redirectURL, err := url.Parse(redirectURI)
+	if err != nil {
+		return false
+	}
+
+	return redirectURL.Scheme == registeredURL.Scheme &&
+		redirectURL.Hostname() == registeredURL.Hostname() &&
+		redirectURL.EscapedPath() == registeredURL.EscapedPath() &&
+		redirectURL.RawQuery == registeredURL.RawQuery &&
+		redirectURL.User == nil &&
+		redirectURL.Fragment == ""
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// HashSecret returns the salted bcrypt hash of a client secret, to be stored as SecretHash.
+// A cost lower than bcrypt.MinCost is replaced with bcrypt.DefaultCost.
+func HashSecret(secret string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), cost)
+	if err != nil {
+		return "", fmt.Errorf("hash secret: %w", err)
+	}
+
+	return string(hash), nil
+}
+
+// setSecret stores the hash of the secret instead of the secret itself.
+func (c *Client) setSecret(secret string, cost int) error {
+	c.Secret, c.SecretHash = "", ""
+
+	if secret == "" {
+		return nil
+	}
+
+	hash, err := HashSecret(secret, cost)
+	if err != nil {
+		return err
+	}
+
+	c.SecretHash = hash
+
+	return nil
+}
+
+// VerifyPassword checks the secret sent by the client in constant time.
+func (c *Client) VerifyPassword(secret string) bool {
+	if c.SecretHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(c.SecretHash), []byte(secret)) == nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(c.Secret)) == 1
+}
+
+// AllowedAuthMethods returns the methods the client may authenticate with.
+// Unless set, public clients use none, and the others what they registered: a secret, public keys or both.
+func (c *Client) AllowedAuthMethods() []AuthMethod {
+	if len(c.AuthMethods) > 0 {
+		return c.AuthMethods
+	}
+
+	if c.Public {
+		return []AuthMethod{AuthMethodNone}
+	}
+
+	var methods []AuthMethod
+
+	if c.Secret != "" || c.SecretHash != "" {
+		methods = append(methods, AuthMethodClientSecretBasic, AuthMethodClientSecretPost)
+	}
+
+	if len(c.PublicKeys) > 0 {
+		methods = append(methods, AuthMethodPrivateKeyJWT)
+	}
+
+	return methods
+}
+
+// AllowsAuthMethod reports whether the client may authenticate with the method.
+func (c *Client) AllowsAuthMethod(method AuthMethod) bool {
+	for _, allowed := range c.AllowedAuthMethods() {
+		if allowed == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifySignature reports whether the signature was made by one of the keys of the client.
+func (c *Client) verifySignature(alg string, signed, signature []byte) bool {
+	for _, pemKey := range c.PublicKeys {
+		key, err := ParsePublicKey(pemKey)
+		if err == nil && verifyJWTSignature(alg, key, signed, signature) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RequiresPKCE returns true if the client must use PKCE.
+// Public clients cannot authenticate, so they always do.
+func (c *Client) RequiresPKCE() bool {
+	return c.Public || c.PKCERequired
+}
+
+// toClient converts any oauth2.ClientInfo to a copy of Client.
+func toClient(info oauth2.ClientInfo) *Client {
+	if client, ok := info.(*authenticatedClient); ok {
+		info = client.Client
+	}
+
+	if client, ok := info.(*Client); ok {
+		client := *client
+		client.RedirectURIs = append([]string(nil), client.RedirectURIs...)
+		client.AuthMethods = append([]AuthMethod(nil), client.AuthMethods...)
+		client.PublicKeys = append([]string(nil), client.PublicKeys...)
+		client.Scopes = append([]string(nil), client.Scopes...)
+
+		return &client
+	}
+
+	return &Client{
+		ID:           info.GetID(),
+		Secret:       info.GetSecret(),
+		Domain:       info.GetDomain(),
+		Public:       info.IsPublic(),
+		UserID:       info.GetUserID(),
+		SecretHash:   "",
+		RedirectURIs: nil,
+		APIURL:       "",
+		DocumentURL:  "",
+		PKCERequired: false,
+		Disabled:     false,
+		AuthMethods:  nil,
+		PublicKeys:   nil,
+		Scopes:       nil,
+
+		TokensNotBefore: time.Time{},
+		FromClientsFile: false,
+	}
+}
+
+// revoked reports whether a token created at the given time was revoked along with all the tokens of the client.
+func (c *Client) revoked(createdAt time.Time) bool {
+	return createdAt.Before(c.TokensNotBefore)
+}
+
+// getter returns the Digiposte configuration of the client, overriding the URLs of the given one.
+func (c *Client) getter(base digiconfig.Getter) digiconfig.Getter { //nolint:ireturn
+	return digiconfig.GetterFunc(func(key string) (string, bool) {
+		switch {
+		case key == digiconfig.APIURLKey && c.APIURL != "":
+			return c.APIURL, true
+		case key == digiconfig.DocumentURLKey && c.DocumentURL != "":
+			return c.DocumentURL, true
+		}
+
+		return base.Get(key)
+	})
+}
+
+// enabledClientStore hides the disabled clients from the oauth flows.
+type enabledClientStore struct {
+	ClientStore
+}
+
+func (s *enabledClientStore) GetByID(ctx context.Context, id string) (oauth2.ClientInfo, error) { //nolint:ireturn
+	info, err := s.ClientStore.GetByID(ctx, id)
+	if err != nil || info == nil {
+		return info, err //nolint:wrapcheck
+	}
+
+	client := toClient(info)
+	if client.Disabled {
+		return nil, nil //nolint:nilnil
+	}
+
+	if authenticatedClientID(ctx) == id {
+		return &authenticatedClient{Client: client}, nil
+	}
+
+	return info, nil
+}
+
+// bearerClient returns the access token of the request and its client.
+// It fails if the client was disabled or deleted, or its tokens were revoked, since the token was issued.
+func (e *endpoints) bearerClient(r *http.Request) (oauth2.TokenInfo, *Client, error) { //nolint:ireturn
+	token, err := e.oauthServer.ValidationBearerToken(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("validate token: %w", err)
+	}
+
+	client, err := e.tokenClient(r.Context(), token, token.GetAccessCreateAt())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return token, client, nil
+}
+
+// tokenClient returns the client of a token created at the given time,
+// unless the client was disabled or deleted, or its tokens were revoked since.
+func (e *endpoints) tokenClient(ctx context.Context, token oauth2.TokenInfo, createdAt time.Time) (*Client, error) {
+	info, err := e.manager.GetClient(ctx, token.GetClientID())
+	if err != nil {
+		return nil, fmt.Errorf("get client: %w", err)
+	}
+
+	client := toClient(info)
+	if client.revoked(createdAt) {
+		return nil, oautherrs.ErrInvalidAccessToken
+	}
+
+	return client, nil
+}
+
+// WithPublicClient registers a client that cannot keep a secret, such as a desktop application.
+// Public clients must use PKCE.
+type WithPublicClient struct{}
+
+func (o *WithPublicClient) Apply(instance interface{}) error {
+	if client, ok := instance.(*Client); ok {
+		client.Public = true
+
+		return nil
+	}
+
+	return &InvalidTypeOptionError{instance: instance}
+}
+
+// WithRedirectURIs allows more redirect URIs than the one given at registration.
+type WithRedirectURIs struct {
+	URIs []string
+}
+
+func (o *WithRedirectURIs) Apply(instance interface{}) error {
+	if client, ok := instance.(*Client); ok {
+		client.RedirectURIs = append(client.RedirectURIs, o.URIs...)
+
+		return nil
+	}
+
+	return &InvalidTypeOptionError{instance: instance}
+}
+
+// WithAuthMethods restricts the methods the client may authenticate with.
+type WithAuthMethods struct {
+	Methods []AuthMethod
+}
+
+func (o *WithAuthMethods) Apply(instance interface{}) error {
+	if client, ok := instance.(*Client); ok {
+		client.AuthMethods = append(client.AuthMethods, o.Methods...)
+
+		return nil
+	}
+
+	return &InvalidTypeOptionError{instance: instance}
+}
+
+// WithPublicKeys registers the PEM encoded public keys of the client, to authenticate with private_key_jwt.
+type WithPublicKeys struct {
+	Keys []string
+}
+
+func (o *WithPublicKeys) Apply(instance interface{}) error {
+	if client, ok := instance.(*Client); ok {
+		client.PublicKeys = append(client.PublicKeys, o.Keys...)
+
+		return nil
+	}
+
+	return &InvalidTypeOptionError{instance: instance}
+}
+
+// WithScopes restricts the scopes the client may be granted.
+type WithScopes struct {
+	Scopes []string
+}
+
+func (o *WithScopes) Apply(instance interface{}) error {
+	if client, ok := instance.(*Client); ok {
+		client.Scopes = append(client.Scopes, o.Scopes...)
+
+		return nil
+	}
+
+	return &InvalidTypeOptionError{instance: instance}
+}
+
+// WithPKCERequired rejects authorization requests of the client without a code_challenge.
+type WithPKCERequired struct{}
+
+func (o *WithPKCERequired) Apply(instance interface{}) error {
+	if client, ok := instance.(*Client); ok {
+		client.PKCERequired = true
+
+		return nil
+	}
+
+	return &InvalidTypeOptionError{instance: instance}
+}
+
+var (
+	errPublicClientSecret  = errors.New("public clients must not have a secret")
+	errRedirectURIFragment = errors.New("redirect URIs must not have a fragment")
+	errUnknownAuthMethod   = errors.New("unknown authentication method")
+	errPublicAuthMethod    = errors.New("public clients can only use the none authentication method")
+	errNoneAuthMethod      = errors.New("only public clients can use the none authentication method")
+	errMissingPublicKeys   = errors.New("private_key_jwt requires public keys")
+)
+
+func validateClient(client *Client) error {
+	if client.Public && (client.Secret != "" || client.SecretHash != "") {
+		return &InvalidClientError{ClientID: client.ID, Err: errPublicClientSecret}
+	}
+
+	for _, redirectURI := range client.RedirectURIs {
+		if err := validateAbsoluteURL(redirectURI); err != nil {
+			return &InvalidClientError{ClientID: client.ID, Err: err}
+		}
+
+		if strings.Contains(redirectURI, "#") {
+			return &InvalidClientError{ClientID: client.ID, Err: errRedirectURIFragment}
+		}
+	}
+
+	for _, pemKey := range client.PublicKeys {
+		if _, err := ParsePublicKey(pemKey); err != nil {
+			return &InvalidClientError{ClientID: client.ID, Err: err}
+		}
+	}
+
+	if err := validateAuthMethods(client); err != nil {
+		return &InvalidClientError{ClientID: client.ID, Err: err}
+	}
+
+	if err := validateScopes(client.Scopes); err != nil {
+		return &InvalidClientError{ClientID: client.ID, Err: err}
+	}
+
+	return nil
+}
+
+func validateAuthMethods(client *Client) error {
+	for _, method := range client.AuthMethods {
+		switch {
+		case !method.valid():
+			return fmt.Errorf("%w: %q", errUnknownAuthMethod, method)
+		case client.Public && method != AuthMethodNone:
+			return errPublicAuthMethod
+		case !client.Public && method == AuthMethodNone:
+			return errNoneAuthMethod
+		case method == AuthMethodPrivateKeyJWT && len(client.PublicKeys) == 0:
+			return errMissingPublicKeys
+		}
+	}
+
+	return nil
+}
+
+type InvalidClientError struct {
+	ClientID string
+	Err      error
+}
+
+func (e *InvalidClientError) Error() string {
+	return fmt.Sprintf("client %q: %v", e.ClientID, e.Err)
+}
+
+func (e *InvalidClientError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,285 @@
+package digipoauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
+)
+
+const (
+	// AssertionLeeway is the clock skew tolerated on the times of client assertions.
+	AssertionLeeway = time.Minute
+	// MaxAssertionLifetime is the longest lifetime accepted for client assertions, bounding the replay cache.
+	MaxAssertionLifetime = 10 * time.Minute
+)
+
+// AssertionSigningAlgorithms are the algorithms accepted for the client assertions.
+var AssertionSigningAlgorithms = []string{"RS256", "ES256", "EdDSA"} //nolint:gochecknoglobals
+
+var (
+	errMalformedJWT        = errors.New("malformed JWT")
+	errUnsupportedJWTAlg   = errors.New("unsupported signing algorithm")
+	errJWTSignature        = errors.New("signature does not match any key of the client")
+	errAssertionIssuer     = errors.New("iss and sub must be the client_id")
+	errAssertionAudience   = errors.New("aud does not identify this server")
+	errAssertionExpired    = errors.New("expired")
+	errAssertionNotYet     = errors.New("not valid yet")
+	errAssertionLifetime   = errors.New("exp is too far in the future")
+	errAssertionReplayed   = errors.New("jti was already used")
+	errAssertionMissingJTI = errors.New("jti is required")
+	errNoPublicKey         = errors.New("no PEM encoded public key")
+	errUnsupportedKey      = errors.New("unsupported public key type")
+)
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// assertionClaims are the claims of a client assertion, as specified by RFC 7523.
+type assertionClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti"`
+}
+
+// audience is the aud claim, either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("aud: %w", err)
+	}
+
+	*a = multiple
+
+	return nil
+}
+
+// parseJWT decodes the parts of a compact JWT without verifying it.
+func parseJWT(token string, claims interface{}) (*jwtHeader, []byte, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 { //nolint:gomnd // header, payload and signature.
+		return nil, nil, nil, errMalformedJWT
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, nil, nil, fmt.Errorf("header: %w", err)
+	}
+
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, nil, nil, fmt.Errorf("claims: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("signature: %w", err)
+	}
+
+	return &header, []byte(parts[0] + "." + parts[1]), signature, nil
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformedJWT, err) //nolint:errorlint
+	}
+
+	if err := json.Unmarshal(content, value); err != nil {
+		return fmt.Errorf("%w: %v", errMalformedJWT, err) //nolint:errorlint
+	}
+
+	return nil
+}
+
+// verifyJWTSignature checks the signature of the signed content with the public key, according to the algorithm.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8 //nolint:gomnd // bits to bytes.
+		if alg != "ES256" || len(signature) != 2*size {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		return ecdsa.Verify(key, digest[:], r, s)
+
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, signed, signature)
+	}
+
+	return false
+}
+
+// ParsePublicKey parses a PEM encoded public key, as registered for the private_key_jwt method.
+func ParsePublicKey(pemKey string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errNoPublicKey
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: %T", errUnsupportedKey, key)
+}
+
+// assertionSubject returns the client identified by the assertion, before it is verified.
+// The client_id of the form is optional, but must match when given.
+func assertionSubject(assertion, clientID string) (string, error) {
+	var claims assertionClaims
+	if _, _, _, err := parseJWT(assertion, &claims); err != nil {
+		return "", oautherrs.ErrInvalidClient
+	}
+
+	if clientID != "" && clientID != claims.Subject {
+		return "", oautherrs.ErrInvalidRequest
+	}
+
+	return claims.Subject, nil
+}
+
+// assertionVerifier verifies the client assertions and remembers their identifiers until they expire,
+// so that each assertion is used once.
+type assertionVerifier struct {
+	mutex sync.Mutex
+	used  map[string]time.Time
+	now   func() time.Time
+}
+
+func newAssertionVerifier() *assertionVerifier {
+	return &assertionVerifier{
+		mutex: sync.Mutex{},
+		used:  make(map[string]time.Time),
+		now:   time.Now,
+	}
+}
+
+// verify checks that the assertion is signed by a key of the client, issued for one of the audiences, and not replayed.
+func (v *assertionVerifier) verify(client *Client, assertion string, audiences []string) error {
+	var claims assertionClaims
+
+	header, signed, signature, err := parseJWT(assertion, &claims)
+	if err != nil {
+		return err
+	}
+
+	if !stringsContain(AssertionSigningAlgorithms, header.Algorithm) {
+		return fmt.Errorf("%w: %q", errUnsupportedJWTAlg, header.Algorithm)
+	}
+
+	if !client.verifySignature(header.Algorithm, signed, signature) {
+		return errJWTSignature
+	}
+
+	if claims.Issuer != client.ID || claims.Subject != client.ID {
+		return errAssertionIssuer
+	}
+
+	if !audienceMatches(claims.Audience, audiences) {
+		return errAssertionAudience
+	}
+
+	if claims.ID == "" {
+		return errAssertionMissingJTI
+	}
+
+	now := v.now()
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+
+	switch {
+	case !now.Before(expiresAt.Add(AssertionLeeway)):
+		return errAssertionExpired
+	case claims.NotBefore != 0 && now.Add(AssertionLeeway).Before(time.Unix(claims.NotBefore, 0)):
+		return errAssertionNotYet
+	case expiresAt.After(now.Add(MaxAssertionLifetime + AssertionLeeway)):
+		return errAssertionLifetime
+	}
+
+	return v.use(client.ID+"\x00"+claims.ID, expiresAt.Add(AssertionLeeway))
+}
+
+// use records the identifier of an assertion, failing if it was already used.
+func (v *assertionVerifier) use(id string, expiresAt time.Time) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	now := v.now()
+
+	for usedID, usedUntil := range v.used {
+		if now.After(usedUntil) {
+			delete(v.used, usedID)
+		}
+	}
+
+	if _, ok := v.used[id]; ok {
+		return errAssertionReplayed
+	}
+
+	v.used[id] = expiresAt
+
+	return nil
+}
+
+func audienceMatches(claimed audience, audiences []string) bool {
+	for _, aud := range claimed {
+		if stringsContain(audiences, aud) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func stringsContain(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
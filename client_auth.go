@@ -0,0 +1,276 @@
+package digipoauth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
+)
+
+// AuthMethod is a method used by a client to authenticate to the server, as named by RFC 7591.
+type AuthMethod string
+
+const (
+	// AuthMethodNone is used by public clients, identified by their client_id only.
+	AuthMethodNone AuthMethod = "none"
+	// AuthMethodClientSecretBasic sends the secret in the Authorization header.
+	AuthMethodClientSecretBasic AuthMethod = "client_secret_basic"
+	// AuthMethodClientSecretPost sends the secret in the form.
+	AuthMethodClientSecretPost AuthMethod = "client_secret_post"
+	// AuthMethodPrivateKeyJWT sends a JWT signed by a key of the client, as specified by RFC 7523.
+	AuthMethodPrivateKeyJWT AuthMethod = "private_key_jwt"
+
+	// ClientAssertionType is the only client_assertion_type accepted with private_key_jwt.
+	ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// AuthMethods are the methods supported by the server.
+var AuthMethods = []AuthMethod{ //nolint:gochecknoglobals
+	AuthMethodClientSecretBasic,
+	AuthMethodClientSecretPost,
+	AuthMethodPrivateKeyJWT,
+	AuthMethodNone,
+}
+
+func (m AuthMethod) String() string {
+	return string(m)
+}
+
+func (m AuthMethod) valid() bool {
+	for _, method := range AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientAuthentication is what a request presents to authenticate the client.
+type clientAuthentication struct {
+	method    AuthMethod
+	clientID  string
+	secret    string
+	assertion string
+}
+
+// authenticateClient authenticates the client of a request with any of the methods allowed for it.
+func (e *endpoints) authenticateClient(r *http.Request) (*Client, error) {
+	auth, err := readClientAuthentication(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.method == AuthMethodPrivateKeyJWT {
+		// The client is identified by the assertion, which is verified against its keys below.
+		auth.clientID, err = assertionSubject(auth.assertion, r.Form.Get("client_id"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if auth.clientID == "" {
+		return nil, oautherrs.ErrInvalidClient
+	}
+
+	info, err := e.manager.GetClient(r.Context(), auth.clientID)
+	if err != nil || info == nil {
+		return nil, oautherrs.ErrInvalidClient
+	}
+
+	client := toClient(info)
+
+	if !client.AllowsAuthMethod(auth.method) {
+		return nil, oautherrs.ErrInvalidClient
+	}
+
+	switch auth.method {
+	case AuthMethodNone:
+		// Only public clients may use it.
+	case AuthMethodClientSecretBasic, AuthMethodClientSecretPost:
+		if !verifyClientSecret(info, auth.secret) {
+			return nil, oautherrs.ErrInvalidClient
+		}
+
+		if client.SecretHash == "" && client.Secret != "" {
+			e.rehashSecret(r.Context(), client.ID, auth.secret)
+		}
+	case AuthMethodPrivateKeyJWT:
+		// The audiences come from the configuration, as the Host header is chosen by the client.
+		audiences := make([]string, 0, 3*len(e.issuers)) //nolint:gomnd
+		for _, issuer := range e.issuers {
+			audiences = append(audiences, issuer, issuer+TokenPath, issuer+r.URL.Path)
+		}
+
+		if err := e.assertions.verify(client, auth.assertion, audiences); err != nil {
+			e.logger.Printf("Rejected the client assertion of %q: %v", client.ID, err)
+
+			return nil, oautherrs.ErrInvalidClient
+		}
+	}
+
+	return client, nil
+}
+
+// readClientAuthentication finds out the authentication method used by the request.
+// Using more than one method is an error, as required by RFC 6749.
+func readClientAuthentication(r *http.Request) (*clientAuthentication, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, oautherrs.ErrInvalidRequest
+	}
+
+	auth := &clientAuthentication{
+		method:    AuthMethodNone,
+		clientID:  r.Form.Get("client_id"),
+		secret:    "",
+		assertion: "",
+	}
+
+	methods := 0
+
+	if username, password, ok := r.BasicAuth(); ok {
+		methods++
+
+		// Both are form-encoded before being put in the header.
+		auth.clientID = formUnescape(username)
+		auth.secret = formUnescape(password)
+
+		// Public clients may only identify themselves with the header.
+		if auth.secret != "" {
+			auth.method = AuthMethodClientSecretBasic
+		}
+
+		if clientID := r.Form.Get("client_id"); clientID != "" && clientID != auth.clientID {
+			return nil, oautherrs.ErrInvalidRequest
+		}
+	}
+
+	if r.Form.Get("client_secret") != "" {
+		methods++
+
+		auth.method = AuthMethodClientSecretPost
+		auth.secret = r.Form.Get("client_secret")
+	}
+
+	if assertion := r.Form.Get("client_assertion"); assertion != "" {
+		methods++
+
+		if r.Form.Get("client_assertion_type") != ClientAssertionType {
+			return nil, oautherrs.ErrInvalidRequest
+		}
+
+		auth.method = AuthMethodPrivateKeyJWT
+		auth.assertion = assertion
+	}
+
+	if methods > 1 {
+		return nil, oautherrs.ErrInvalidRequest
+	}
+
+	return auth, nil
+}
+
+func formUnescape(value string) string {
+	if unescaped, err := url.QueryUnescape(value); err == nil {
+		return unescaped
+	}
+
+	return value
+}
+
+// rehashSecret replaces the plaintext secret of a client, stored before the secrets were hashed, with its hash.
+// The client authenticated with it, so that it is accepted this one last time.
+func (e *endpoints) rehashSecret(ctx context.Context, clientID, secret string) {
+	info, err := e.clientStore.GetByID(ctx, clientID)
+	if err != nil || info == nil {
+		return
+	}
+
+	client := toClient(info)
+	// The secret may have been rotated in the meantime.
+	if client.SecretHash != "" || client.Secret != secret {
+		return
+	}
+
+	if err := client.setSecret(secret, e.secretHashCost); err != nil {
+		e.logger.Printf("Failed to hash the secret of client %q: %v", clientID, err)
+
+		return
+	}
+
+	if err := e.clientStore.Set(clientID, client); err != nil {
+		e.logger.Printf("Failed to store the hashed secret of client %q: %v", clientID, err)
+
+		return
+	}
+
+	e.logger.Printf("Replaced the plaintext secret of client %q with its hash", clientID)
+}
+
+func verifyClientSecret(info oauth2.ClientInfo, secret string) bool {
+	if verifier, ok := info.(oauth2.ClientPasswordVerifier); ok {
+		return verifier.VerifyPassword(secret)
+	}
+
+	return toClient(info).VerifyPassword(secret)
+}
+
+type authenticatedClientKey struct{}
+
+// withAuthenticatedClient marks the client as already authenticated for the token endpoint,
+// whose manager only knows about client secrets.
+func withAuthenticatedClient(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, authenticatedClientKey{}, client.ID)
+}
+
+func authenticatedClientID(ctx context.Context) string {
+	clientID, _ := ctx.Value(authenticatedClientKey{}).(string)
+
+	return clientID
+}
+
+// authenticatedClient is a client already authenticated by authenticateClient.
+type authenticatedClient struct {
+	*Client
+}
+
+var _ oauth2.ClientPasswordVerifier = (*authenticatedClient)(nil)
+
+// VerifyPassword accepts any secret: the client authenticated with its own method.
+func (c *authenticatedClient) VerifyPassword(string) bool {
+	return true
+}
+
+// clientInfoHandler reads the client of a token request authenticated beforehand.
+func clientInfoHandler(r *http.Request) (string, string, error) {
+	clientID := authenticatedClientID(r.Context())
+	if clientID == "" {
+		return "", "", oautherrs.ErrInvalidClient
+	}
+
+	return clientID, "", nil
+}
+
+// authMethodNames returns the names of the methods.
+func authMethodNames(methods []AuthMethod) []string {
+	names := make([]string, 0, len(methods))
+
+	for _, method := range methods {
+		names = append(names, method.String())
+	}
+
+	return names
+}
+
+// writeError writes an oauth error response as the token endpoint does.
+func (e *endpoints) writeError(w http.ResponseWriter, err error) {
+	data, status, header := e.oauthServer.GetErrorData(err)
+
+	for key := range header {
+		w.Header().Set(key, header.Get(key))
+	}
+
+	writeJSON(w, status, data)
+}
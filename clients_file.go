@@ -0,0 +1,495 @@
+package digipoauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultClientsFileInterval is the default interval at which the clients file is checked for changes.
+const DefaultClientsFileInterval = 5 * time.Second
+
+// ClientsFileConfig declares the clients in a YAML or JSON file, chosen by its extension.
+// The file is loaded at startup and applied again when it changes, or by Handler.ReloadClientsFile.
+type ClientsFileConfig struct {
+	Path string
+	// Interval is the interval at which the file is checked for changes. Defaults to DefaultClientsFileInterval.
+	Interval time.Duration
+	// ReloadOnSIGHUP also applies the file again when the process receives SIGHUP.
+	// It is left to the applications, which own the signals of their process.
+	ReloadOnSIGHUP bool
+}
+
+// ClientsFile is the content of a clients file.
+type ClientsFile struct {
+	Clients []*ClientEntry `json:"clients" yaml:"clients"`
+}
+
+// ClientEntry declares a client and the Digiposte account it gives access to.
+type ClientEntry struct {
+	ClientID string `json:"client_id" yaml:"client_id"`
+	// SecretHash is the bcrypt hash of the client secret. Public clients have none.
+	SecretHash   string   `json:"secret_hash,omitempty"   yaml:"secret_hash,omitempty"`
+	Public       bool     `json:"public,omitempty"        yaml:"public,omitempty"`
+	PKCERequired bool     `json:"pkce_required,omitempty" yaml:"pkce_required,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"           yaml:"redirect_uris"`
+
+	// AuthMethods restricts the methods the client may authenticate with.
+	AuthMethods []AuthMethod `json:"auth_methods,omitempty" yaml:"auth_methods,omitempty"`
+	// PublicKeys are the PEM encoded public keys verifying the assertions of the private_key_jwt method.
+	PublicKeys []string `json:"public_keys,omitempty" yaml:"public_keys,omitempty"`
+	// Scopes restricts the scopes the client may be granted. All the supported scopes are allowed if empty.
+	Scopes []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+
+	Username  string     `json:"username"             yaml:"username"`
+	Password  *SecretRef `json:"password"             yaml:"password"`
+	OTPSecret *SecretRef `json:"otp_secret,omitempty" yaml:"otp_secret,omitempty"`
+
+	APIURL      string `json:"api_url,omitempty"      yaml:"api_url,omitempty"`
+	DocumentURL string `json:"document_url,omitempty" yaml:"document_url,omitempty"`
+}
+
+// SecretRef references a secret, so that it is not written in the clients file.
+// Exactly one of the fields must be set.
+type SecretRef struct {
+	// Env is the name of the environment variable holding the secret.
+	Env string `json:"env,omitempty" yaml:"env,omitempty"`
+	// File is the path of the file holding the secret. The trailing new line is ignored.
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	// Value is the secret itself.
+	Value string `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+var (
+	errInvalidSecretRef   = errors.New("exactly one of env, file and value is required")
+	errUnsetEnv           = errors.New("environment variable is not set")
+	errDuplicateClient    = errors.New("duplicate client id")
+	errMissingSecretHash  = errors.New("confidential clients require a secret_hash or public_keys")
+	errMissingRedirectURI = errors.New("at least one redirect URI is required")
+	errRelativeURL        = errors.New("absolute URL required")
+)
+
+// Resolve returns the referenced secret.
+func (r *SecretRef) Resolve() (string, error) {
+	set := 0
+
+	for _, field := range []string{r.Env, r.File, r.Value} {
+		if field != "" {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return "", errInvalidSecretRef
+	}
+
+	switch {
+	case r.Env != "":
+		value, ok := os.LookupEnv(r.Env)
+		if !ok {
+			return "", fmt.Errorf("%w: %s", errUnsetEnv, r.Env)
+		}
+
+		return value, nil
+
+	case r.File != "":
+		content, err := os.ReadFile(r.File)
+		if err != nil {
+			return "", fmt.Errorf("read: %w", err)
+		}
+
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	return r.Value, nil
+}
+
+// ClientEntryError reports an invalid entry of the clients file.
+type ClientEntryError struct {
+	Index    int
+	ClientID string
+	Err      error
+}
+
+func (e *ClientEntryError) Error() string {
+	return fmt.Sprintf("client %d (%q): %v", e.Index, e.ClientID, e.Err)
+}
+
+func (e *ClientEntryError) Unwrap() error {
+	return e.Err
+}
+
+// ClientsFileError reports all the invalid entries of a clients file.
+type ClientsFileError struct {
+	Path    string
+	Entries []*ClientEntryError
+}
+
+func (e *ClientsFileError) Error() string {
+	messages := make([]string, 0, len(e.Entries))
+
+	for _, entry := range e.Entries {
+		messages = append(messages, entry.Error())
+	}
+
+	return fmt.Sprintf("%s: %d invalid clients: %s", e.Path, len(e.Entries), strings.Join(messages, "; "))
+}
+
+// LoadClientsFile reads a YAML or JSON clients file.
+func LoadClientsFile(path string) (*ClientsFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %q: %w", path, err)
+	}
+
+	return parseClientsFile(path, content)
+}
+
+func parseClientsFile(path string, content []byte) (*ClientsFile, error) {
+	var file ClientsFile
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+
+		err := decoder.Decode(&file)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal %q: %w", path, err)
+		}
+
+	default:
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+
+		// An empty file declares no client.
+		if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("unmarshal %q: %w", path, err)
+		}
+	}
+
+	return &file, nil
+}
+
+// resolvedClient is a valid entry of the clients file.
+type resolvedClient struct {
+	client      *Client
+	credentials *Credentials
+}
+
+// resolve validates the entries and resolves their secrets.
+// The valid entries are returned along with the errors of the invalid ones.
+func (f *ClientsFile) resolve() ([]*resolvedClient, []*ClientEntryError) {
+	var (
+		clients = make([]*resolvedClient, 0, len(f.Clients))
+		errs    []*ClientEntryError
+		seen    = make(map[string]bool, len(f.Clients))
+	)
+
+	for index, entry := range f.Clients {
+		resolved, err := entry.resolve()
+		if err == nil && seen[entry.ClientID] {
+			err = errDuplicateClient
+		}
+
+		if err != nil {
+			errs = append(errs, &ClientEntryError{Index: index, ClientID: entry.ClientID, Err: err})
+
+			continue
+		}
+
+		seen[entry.ClientID] = true
+
+		clients = append(clients, resolved)
+	}
+
+	return clients, errs
+}
+
+func (e *ClientEntry) resolve() (*resolvedClient, error) {
+	if e.ClientID == "" {
+		return nil, &RequiredFieldError{Field: "client_id"}
+	}
+
+	if err := e.validateSecret(); err != nil {
+		return nil, err
+	}
+
+	if err := e.validateURLs(); err != nil {
+		return nil, err
+	}
+
+	if e.Password == nil {
+		return nil, &RequiredFieldError{Field: "password"}
+	}
+
+	password, err := e.Password.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("password: %w", err)
+	}
+
+	var otpSecret string
+
+	if e.OTPSecret != nil {
+		otpSecret, err = e.OTPSecret.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("otp_secret: %w", err)
+		}
+	}
+
+	creds := &Credentials{
+		Username:  e.Username,
+		Password:  password,
+		OTPSecret: otpSecret,
+	}
+
+	if err := areCredentialsValid(creds); err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		ID:           e.ClientID,
+		Secret:       "",
+		Domain:       e.RedirectURIs[0],
+		Public:       e.Public,
+		UserID:       e.ClientID,
+		SecretHash:   e.SecretHash,
+		RedirectURIs: e.RedirectURIs,
+		APIURL:       e.APIURL,
+		DocumentURL:  e.DocumentURL,
+		PKCERequired: e.PKCERequired,
+		Disabled:     false,
+		AuthMethods:  e.AuthMethods,
+		PublicKeys:   e.PublicKeys,
+		Scopes:       e.Scopes,
+
+		TokensNotBefore: time.Time{},
+		FromClientsFile: true,
+	}
+
+	if err := validateClient(client); err != nil {
+		return nil, err
+	}
+
+	return &resolvedClient{
+		client:      client,
+		credentials: creds,
+	}, nil
+}
+
+func (e *ClientEntry) validateSecret() error {
+	switch {
+	case e.Public && e.SecretHash != "":
+		return errPublicClientSecret
+	case !e.Public && e.SecretHash == "" && len(e.PublicKeys) == 0:
+		return errMissingSecretHash
+	case e.SecretHash != "":
+		if _, err := bcrypt.Cost([]byte(e.SecretHash)); err != nil {
+			return fmt.Errorf("secret_hash: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (e *ClientEntry) validateURLs() error {
+	if len(e.RedirectURIs) == 0 {
+		return errMissingRedirectURI
+	}
+
+	for name, value := range map[string]string{"api_url": e.APIURL, "document_url": e.DocumentURL} {
+		if value == "" {
+			continue
+		}
+
+		if err := validateAbsoluteURL(value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func validateAbsoluteURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	if !parsed.IsAbs() || parsed.Host == "" {
+		return fmt.Errorf("%w: %q", errRelativeURL, value)
+	}
+
+	return nil
+}
+
+// clientsFileWatcher applies a clients file to a handler, then again when it changes or on SIGHUP if enabled.
+type clientsFileWatcher struct {
+	handler  *Handler
+	path     string
+	interval time.Duration
+	hangup   bool
+
+	mutex    sync.Mutex
+	checksum [sha256.Size]byte
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newClientsFileWatcher(handler *Handler, config *ClientsFileConfig) *clientsFileWatcher {
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultClientsFileInterval
+	}
+
+	return &clientsFileWatcher{
+		handler:  handler,
+		path:     config.Path,
+		interval: interval,
+		hangup:   config.ReloadOnSIGHUP,
+		mutex:    sync.Mutex{},
+		checksum: [sha256.Size]byte{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// reload applies the file if it changed, or unconditionally if force is true.
+// Invalid entries are reported and leave the corresponding clients unchanged.
+func (w *clientsFileWatcher) reload(ctx context.Context, force bool) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	content, err := os.ReadFile(w.path)
+	if err != nil {
+		return fmt.Errorf("read %q: %w", w.path, err)
+	}
+
+	checksum := sha256.Sum256(content)
+	if !force && checksum == w.checksum {
+		return nil
+	}
+
+	file, err := parseClientsFile(w.path, content)
+	if err != nil {
+		return err
+	}
+
+	clients, errs := file.resolve()
+
+	declared := make(map[string]bool, len(file.Clients))
+	for _, entry := range file.Clients {
+		declared[entry.ClientID] = true
+	}
+
+	for _, resolved := range clients {
+		// A client disabled through the admin API stays disabled.
+		if existing, err := w.handler.clientStore.GetByID(ctx, resolved.client.ID); err == nil && existing != nil {
+			resolved.client.Disabled = toClient(existing).Disabled
+		}
+
+		if err := w.handler.applyClient(resolved.client, resolved.credentials); err != nil {
+			errs = append(errs, &ClientEntryError{Index: -1, ClientID: resolved.client.ID, Err: err})
+		}
+	}
+
+	deleteErrs, err := w.deleteUndeclared(ctx, declared)
+	if err != nil {
+		return err
+	}
+
+	errs = append(errs, deleteErrs...)
+
+	w.checksum = checksum
+
+	if len(errs) > 0 {
+		return &ClientsFileError{Path: w.path, Entries: errs}
+	}
+
+	return nil
+}
+
+// deleteUndeclared deletes the clients which were declared by the file and were removed from it since.
+// The invalid entries are still declared: their clients are left as they were.
+func (w *clientsFileWatcher) deleteUndeclared(
+	ctx context.Context,
+	declared map[string]bool,
+) ([]*ClientEntryError, error) {
+	clientStore, err := w.handler.managedClientStore()
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := clientStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("list clients: %w", err)
+	}
+
+	var errs []*ClientEntryError
+
+	for _, info := range infos {
+		client := toClient(info)
+		if !client.FromClientsFile || declared[client.ID] {
+			continue
+		}
+
+		if err := w.handler.DeleteClient(ctx, client.ID); err != nil && !errors.Is(err, ErrUnknownClient) {
+			errs = append(errs, &ClientEntryError{Index: -1, ClientID: client.ID, Err: err})
+		}
+	}
+
+	return errs, nil
+}
+
+// watch applies the file when it changes or on SIGHUP if enabled, until close is called.
+func (w *clientsFileWatcher) watch(logger *log.Logger) {
+	defer close(w.done)
+
+	hangup := make(chan os.Signal, 1)
+	if w.hangup {
+		signal.Notify(hangup, syscall.SIGHUP)
+
+		defer signal.Stop(hangup)
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		force := false
+
+		select {
+		case <-w.stop:
+			return
+		case <-hangup:
+			force = true
+		case <-ticker.C:
+		}
+
+		if err := w.reload(context.Background(), force); err != nil {
+			logger.Printf("Failed to reload the clients file: %v", err)
+		}
+	}
+}
+
+func (w *clientsFileWatcher) close() {
+	close(w.stop)
+	<-w.done
+}
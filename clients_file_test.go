@@ -0,0 +1,254 @@
+package digipoauth_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4/server"
+	digipoauth "github.com/holyhope/digiposte-oauth"
+	configfakes "github.com/holyhope/digiposte-oauth/config/configfakes"
+	. "github.com/onsi/ginkgo/v2" //nolint:revive
+	. "github.com/onsi/gomega"    //nolint:revive
+	"github.com/onsi/gomega/gbytes"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Clients file", func() {
+	var (
+		path       string
+		secretHash string
+		config     *digipoauth.Config
+	)
+
+	writeClientsFile := func(content string) {
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		dir := GinkgoT().TempDir()
+		path = filepath.Join(dir, "clients.yaml")
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(ClientSecret), bcrypt.MinCost)
+		Expect(err).ToNot(HaveOccurred())
+
+		secretHash = string(hash)
+
+		passwordFile := filepath.Join(dir, "password")
+		Expect(os.WriteFile(passwordFile, []byte(Password+"\n"), 0o600)).To(Succeed())
+
+		writeClientsFile(`
+clients:
+  - client_id: ` + ClientID + `
+    secret_hash: "` + secretHash + `"
+    redirect_uris: [http://localhost/callback]
+    username: ` + Username + `
+    password: {file: ` + passwordFile + `}
+    otp_secret: {value: ` + OTPSecret + `}
+    api_url: https://api.example.com/v3
+  - client_id: public
+    public: true
+    redirect_uris: [http://127.0.0.1/callback]
+    scopes: [documents:read]
+    username: other
+    password: {value: other-password}
+`)
+
+		config = &digipoauth.Config{
+			Server: server.NewConfig(),
+			Issuer: "http://localhost",
+			Logger: log.New(GinkgoWriter, "", log.Lmsgprefix),
+			ClientsFile: &digipoauth.ClientsFileConfig{
+				Path:     path,
+				Interval: 10 * time.Millisecond,
+			},
+			LoginMethod: digipoauth.LoginMethodFunc(
+				func(context.Context, *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+					return nil, nil, errors.New("unexpected login")
+				},
+			),
+		}
+	})
+
+	newHandler := func() *digipoauth.Handler {
+		handler, err := digipoauth.NewHandler(&configfakes.FakeSetter{}, config)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(handler.Close)
+
+		return handler
+	}
+
+	clientIDs := func(handler *digipoauth.Handler) func() []string {
+		return func() []string {
+			clients, err := handler.Clients()
+			Expect(err).ToNot(HaveOccurred())
+
+			ids := make([]string, 0, len(clients))
+			for _, client := range clients {
+				ids = append(ids, client.ID)
+			}
+
+			return ids
+		}
+	}
+
+	It("Should register the declared clients", func() {
+		handler := newHandler()
+
+		clients, err := handler.Clients()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(clients).To(ConsistOf(
+			&digipoauth.ClientSummary{
+				ID:           ClientID,
+				Domain:       "http://localhost/callback",
+				Public:       false,
+				PKCERequired: false,
+				Disabled:     false,
+				Username:     Username,
+				RedirectURIs: []string{"http://localhost/callback"},
+				AuthMethods: []digipoauth.AuthMethod{
+					digipoauth.AuthMethodClientSecretBasic,
+					digipoauth.AuthMethodClientSecretPost,
+				},
+				Scopes: digipoauth.SupportedScopes,
+			},
+			&digipoauth.ClientSummary{
+				ID:           "public",
+				Domain:       "http://127.0.0.1/callback",
+				Public:       true,
+				PKCERequired: false,
+				Disabled:     false,
+				Username:     "other",
+				RedirectURIs: []string{"http://127.0.0.1/callback"},
+				AuthMethods:  []digipoauth.AuthMethod{digipoauth.AuthMethodNone},
+				Scopes:       []string{digipoauth.ScopeDocumentsRead},
+			},
+		))
+	})
+
+	It("Should report every invalid entry", func() {
+		writeClientsFile(`
+clients:
+  - client_id: missing-hash
+    redirect_uris: [http://localhost/callback]
+    username: ` + Username + `
+    password: {value: ` + Password + `}
+  - client_id: unset-env
+    public: true
+    redirect_uris: [http://localhost/callback]
+    username: ` + Username + `
+    password: {env: DIGIPOSTE_OAUTH_UNSET_VARIABLE}
+  - client_id: valid
+    public: true
+    redirect_uris: [http://localhost/callback]
+    username: ` + Username + `
+    password: {value: ` + Password + `}
+`)
+
+		logs := gbytes.NewBuffer()
+		config.Logger = log.New(io.MultiWriter(logs, GinkgoWriter), "", log.Lmsgprefix)
+
+		handler := newHandler()
+
+		Expect(logs).To(gbytes.Say(`"missing-hash"`))
+		Expect(logs).To(gbytes.Say(`"unset-env"`))
+		Expect(clientIDs(handler)()).To(ConsistOf("valid"))
+	})
+
+	It("Should apply the changes of the file", func() {
+		handler := newHandler()
+
+		writeClientsFile(`
+clients:
+  - client_id: public
+    public: true
+    redirect_uris: [http://127.0.0.1/callback]
+    username: other
+    password: {value: other-password}
+  - client_id: added
+    public: true
+    redirect_uris: [http://127.0.0.1/callback]
+    username: added
+    password: {value: added-password}
+`)
+
+		Eventually(clientIDs(handler)).Should(ConsistOf("public", "added"))
+	})
+
+	It("Should apply the file on demand", func(ctx SpecContext) {
+		config.ClientsFile.Interval = time.Hour
+
+		handler := newHandler()
+
+		writeClientsFile(`
+clients:
+  - client_id: added
+    public: true
+    redirect_uris: [http://127.0.0.1/callback]
+    username: added
+    password: {value: added-password}
+`)
+
+		Expect(handler.ReloadClientsFile(ctx)).To(Succeed())
+		Expect(clientIDs(handler)()).To(ConsistOf("added"))
+	})
+
+	It("Should keep the previous clients when the file becomes invalid", func() {
+		handler := newHandler()
+
+		writeClientsFile(`clients: [{client_id: ` + ClientID + `, unknown_field: true}]`)
+
+		Consistently(clientIDs(handler), 100*time.Millisecond).Should(ConsistOf(ClientID, "public"))
+	})
+
+	It("Should reject the admin changes the file would undo", func(ctx SpecContext) {
+		handler := newHandler()
+
+		_, err := handler.RotateClientSecret(ctx, ClientID)
+		Expect(err).To(MatchError(ContainSubstring("clients file")))
+
+		err = handler.UpdateCredentials(ctx, ClientID, &digipoauth.Credentials{
+			Username:  "",
+			Password:  "new-password",
+			OTPSecret: "",
+		})
+		Expect(err).To(MatchError(ContainSubstring("clients file")))
+	})
+
+	It("Should delete the clients removed from the file while stopped", func() {
+		storePath := filepath.Join(GinkgoT().TempDir(), "clients.json")
+
+		var err error
+
+		config.ClientStore, err = digipoauth.NewFileClientStore(storePath)
+		Expect(err).ToNot(HaveOccurred())
+
+		handler, err := digipoauth.NewHandler(&configfakes.FakeSetter{}, config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler.RegisterUser(
+			"registered", ClientSecret, "http://localhost/callback",
+			Username, Password, OTPSecret,
+		)).To(Succeed())
+		handler.Close()
+
+		writeClientsFile(`
+clients:
+  - client_id: public
+    public: true
+    redirect_uris: [http://127.0.0.1/callback]
+    username: other
+    password: {value: other-password}
+`)
+
+		config.ClientStore, err = digipoauth.NewFileClientStore(storePath)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(clientIDs(newHandler())()).To(ConsistOf("public", "registered"))
+	})
+})
@@ -79,21 +79,55 @@ func SetOTPSecret(m Setter, otpSecret string) {
 }
 
 func Cookies(m Getter) []*http.Cookie {
-	val, ok := m.Get(CookiesKey)
+	cookies, err := LoadCookies(m)
+	if err != nil {
+		panic(err)
+	}
+
+	return cookies
+}
+
+// LoadCookies is like Cookies but returns an error instead of panicking on invalid cookies.
+func LoadCookies(m Getter) ([]*http.Cookie, error) {
+	return loadCookies(m, CookiesKey)
+}
+
+func SetCookies(setter Setter, cookies []*http.Cookie) error {
+	return setCookies(setter, CookiesKey, cookies)
+}
+
+// AccountCookiesKey is the configuration key of the cookies of a Digiposte account,
+// so that the sessions of several accounts are persisted side by side.
+func AccountCookiesKey(username string) string {
+	return CookiesKey + "_" + username
+}
+
+// LoadAccountCookies returns the cookies persisted for the Digiposte account.
+func LoadAccountCookies(m Getter, username string) ([]*http.Cookie, error) {
+	return loadCookies(m, AccountCookiesKey(username))
+}
+
+// SetAccountCookies persists the cookies of the Digiposte account, leaving those of the other accounts unchanged.
+func SetAccountCookies(setter Setter, username string, cookies []*http.Cookie) error {
+	return setCookies(setter, AccountCookiesKey(username), cookies)
+}
+
+func loadCookies(m Getter, key string) ([]*http.Cookie, error) {
+	val, ok := m.Get(key)
 	if !ok {
-		return nil
+		return nil, nil
 	}
 
 	var cypheredCookies []*http.Cookie
 	if err := json.Unmarshal([]byte(val), &cypheredCookies); err != nil {
-		panic(fmt.Errorf("unmarshal cookies: %w", err))
+		return nil, fmt.Errorf("unmarshal cookies: %w", err)
 	}
 
 	cookies := make([]*http.Cookie, 0, len(cypheredCookies))
 
 	for _, cookie := range cypheredCookies {
 		if err := cookie.Valid(); err != nil {
-			panic(fmt.Errorf("invalid cookie %q: %w", cookie.Name, err))
+			return nil, fmt.Errorf("invalid cookie %q: %w", cookie.Name, err)
 		}
 
 		cookie := *cookie
@@ -101,10 +135,10 @@ func Cookies(m Getter) []*http.Cookie {
 		cookies = append(cookies, &cookie)
 	}
 
-	return cookies
+	return cookies, nil
 }
 
-func SetCookies(setter Setter, cookies []*http.Cookie) error {
+func setCookies(setter Setter, key string, cookies []*http.Cookie) error {
 	cypheredCookies := make([]*http.Cookie, 0, len(cookies))
 
 	for _, cookie := range cookies {
@@ -118,7 +152,7 @@ func SetCookies(setter Setter, cookies []*http.Cookie) error {
 		return fmt.Errorf("marshal: %w", err)
 	}
 
-	setter.Set(CookiesKey, string(cookiesBytes))
+	setter.Set(key, string(cookiesBytes))
 
 	return nil
 }
@@ -0,0 +1,335 @@
+package digipoauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
+)
+
+// DefaultConsentRememberFor is the default duration during which a remembered decision is reused.
+const DefaultConsentRememberFor = 30 * 24 * time.Hour
+
+// ConsentConfig asks a human to approve the authorization requests before a code is issued.
+type ConsentConfig struct {
+	// Passphrase is required to approve the requests when not empty. Otherwise a click is enough.
+	Passphrase string
+	// RememberFor is how long a "remember this client" decision is kept. Defaults to DefaultConsentRememberFor.
+	RememberFor time.Duration
+	// RememberPath is the file in which the remembered decisions are persisted. They are kept in memory if empty.
+	RememberPath string
+}
+
+// The fields added by the consent page to the authorization request.
+const (
+	consentTokenField      = "consent_token"
+	consentActionField     = "consent_action"
+	consentPassphraseField = "consent_passphrase"
+	consentRememberField   = "consent_remember"
+)
+
+const consentKeyLength = 32
+
+// consentPage shows the authorization request to a human before a code is issued.
+type consentPage struct {
+	passphrase      string
+	rememberFor     time.Duration
+	key             []byte
+	accessGenerator *AccessGenerator
+	logger          *log.Logger
+
+	decisions *consentDecisions
+}
+
+func newConsentPage(config *ConsentConfig, accessGenerator *AccessGenerator, logger *log.Logger) (*consentPage, error) {
+	if config == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	rememberFor := config.RememberFor
+	if rememberFor <= 0 {
+		rememberFor = DefaultConsentRememberFor
+	}
+
+	// The key only protects the forms rendered by this process.
+	key := make([]byte, consentKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	decisions, err := loadConsentDecisions(config.RememberPath)
+	if err != nil {
+		return nil, fmt.Errorf("remembered decisions: %w", err)
+	}
+
+	return &consentPage{
+		passphrase:      config.Passphrase,
+		rememberFor:     rememberFor,
+		key:             key,
+		accessGenerator: accessGenerator,
+		logger:          logger,
+		decisions:       decisions,
+	}, nil
+}
+
+// authorize returns the user ID once the request is approved.
+// It returns an empty user ID after rendering the page, and ErrAccessDenied if the request is denied.
+func (c *consentPage) authorize(w http.ResponseWriter, r *http.Request) (string, error) {
+	clientID := r.Form.Get("client_id")
+	scopes := strings.Fields(r.Form.Get("scope"))
+	params := authorizationParams(r.Form)
+
+	if c.decisions.remembered(clientID, scopes) {
+		return clientID, nil
+	}
+
+	token := r.PostForm.Get(consentTokenField)
+	if r.Method != http.MethodPost || token == "" {
+		c.render(w, http.StatusOK, params, "")
+
+		return "", nil
+	}
+
+	if !hmac.Equal([]byte(token), []byte(c.token(params))) {
+		c.render(w, http.StatusForbidden, params, "The form has expired, please review the request again.")
+
+		return "", nil
+	}
+
+	if r.PostForm.Get(consentActionField) != "approve" {
+		return "", oautherrs.ErrAccessDenied
+	}
+
+	if !c.validPassphrase(r.PostForm.Get(consentPassphraseField)) {
+		c.render(w, http.StatusForbidden, params, "The passphrase is incorrect.")
+
+		return "", nil
+	}
+
+	if r.PostForm.Get(consentRememberField) != "" {
+		if err := c.decisions.remember(clientID, scopes, time.Now().Add(c.rememberFor)); err != nil {
+			c.logger.Printf("Failed to remember the consent to %q: %v", clientID, err)
+		}
+	}
+
+	return clientID, nil
+}
+
+// validPassphrase compares the passphrase in constant time. Any passphrase is valid if none is configured.
+func (c *consentPage) validPassphrase(passphrase string) bool {
+	return c.passphrase == "" || subtle.ConstantTimeCompare([]byte(passphrase), []byte(c.passphrase)) == 1
+}
+
+// authorizationParams returns the parameters of the authorization request, without those of the consent page.
+func authorizationParams(form url.Values) url.Values {
+	params := make(url.Values, len(form))
+
+	for key, values := range form {
+		if !strings.HasPrefix(key, "consent_") {
+			params[key] = values
+		}
+	}
+
+	return params
+}
+
+// token binds the consent form to the authorization request, so that it cannot be submitted by another site.
+func (c *consentPage) token(params url.Values) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(params.Encode()))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorization request</title></head>
+<body>
+{{- if .Message }}
+<p><strong>{{ .Message }}</strong></p>
+{{- end }}
+<form method="post" action="{{ .Action }}">
+<p>The application <strong>{{ .ClientID }}</strong> requests access to the Digiposte account <strong>{{ .Username }}</strong>.</p>
+<p>Requested scopes:</p>
+<ul>
+{{- range .Scopes }}
+<li>{{ . }}</li>
+{{- else }}
+<li>default access</li>
+{{- end }}
+</ul>
+<p>You will be redirected to <code>{{ .RedirectURI }}</code>.</p>
+{{- range $key, $values := .Params }}
+{{- range $values }}
+<input type="hidden" name="{{ $key }}" value="{{ . }}">
+{{- end }}
+{{- end }}
+<input type="hidden" name="consent_token" value="{{ .Token }}">
+{{- if .PassphraseRequired }}
+<p><label>Passphrase: <input type="password" name="consent_passphrase" autofocus></label></p>
+{{- end }}
+<p><label><input type="checkbox" name="consent_remember" value="1"> Remember this decision for this application</label></p>
+<button type="submit" name="consent_action" value="approve">Approve</button>
+<button type="submit" name="consent_action" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`)) //nolint:gochecknoglobals
+
+type consentView struct {
+	Action             string
+	Message            string
+	ClientID           string
+	Username           string
+	Scopes             []string
+	RedirectURI        string
+	Params             url.Values
+	Token              string
+	PassphraseRequired bool
+}
+
+func (c *consentPage) render(w http.ResponseWriter, status int, params url.Values, message string) {
+	view := &consentView{
+		// The parameters are posted as hidden fields, the query must not add to them.
+		// The relative URL keeps the path prefix under which the handler is mounted.
+		Action:             strings.TrimPrefix(AuthorizePath, "/"),
+		Message:            message,
+		ClientID:           params.Get("client_id"),
+		Username:           "",
+		Scopes:             strings.Fields(params.Get("scope")),
+		RedirectURI:        params.Get("redirect_uri"),
+		Params:             params,
+		Token:              c.token(params),
+		PassphraseRequired: c.passphrase != "",
+	}
+
+	if creds, ok := c.accessGenerator.Credentials(view.ClientID); ok {
+		view.Username = creds.Username
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The page must not be framed by another site to trick the user into approving.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+
+	if err := consentTemplate.Execute(w, view); err != nil {
+		c.logger.Printf("Failed to render consent page: %v", err)
+	}
+}
+
+// consentDecision is a remembered approval of a client.
+type consentDecision struct {
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// consentDecisions holds the remembered approvals, persisted to a file if it has a path.
+type consentDecisions struct {
+	path string
+
+	mutex     sync.Mutex
+	decisions map[string]*consentDecision
+}
+
+func loadConsentDecisions(path string) (*consentDecisions, error) {
+	decisions := &consentDecisions{
+		path:      path,
+		mutex:     sync.Mutex{},
+		decisions: make(map[string]*consentDecision),
+	}
+
+	if path == "" {
+		return decisions, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return decisions, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("read %q: %w", path, err)
+	}
+
+	if err := json.Unmarshal(content, &decisions.decisions); err != nil {
+		return nil, fmt.Errorf("unmarshal %q: %w", path, err)
+	}
+
+	return decisions, nil
+}
+
+// remembered reports whether the client was approved for all the scopes and the decision has not expired.
+func (d *consentDecisions) remembered(clientID string, scopes []string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	decision, ok := d.decisions[clientID]
+	if !ok || time.Now().After(decision.ExpiresAt) {
+		return false
+	}
+
+	approved := make(map[string]bool, len(decision.Scopes))
+	for _, scope := range decision.Scopes {
+		approved[scope] = true
+	}
+
+	for _, scope := range scopes {
+		if !approved[scope] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (d *consentDecisions) remember(clientID string, scopes []string, expiresAt time.Time) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.decisions[clientID] = &consentDecision{
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+
+	return d.save()
+}
+
+// forget drops the decision about the client, so that it is asked again.
+func (d *consentDecisions) forget(clientID string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.decisions, clientID)
+
+	return d.save()
+}
+
+func (d *consentDecisions) save() error {
+	if d.path == "" {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(d.decisions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	return writeFileAtomic(d.path, content)
+}
@@ -0,0 +1,718 @@
+package digipoauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/go-oauth2/oauth2/v4/manage"
+	"github.com/go-oauth2/oauth2/v4/models"
+)
+
+const (
+	// DeviceAuthorizationPath is the path to the device authorization endpoint (RFC 8628).
+	DeviceAuthorizationPath = "/device_authorization"
+	// DeviceVerificationPath is the path to the page where an operator approves a device.
+	DeviceVerificationPath = "/device"
+	// DeviceCodeGrantType is the grant type used by devices to poll the token endpoint.
+	DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// DefaultDeviceCodeExp is the default lifetime of device and user codes.
+	DefaultDeviceCodeExp = 10 * time.Minute
+	// DefaultDeviceInterval is the default minimum interval between two polls of a device.
+	DefaultDeviceInterval = 5 * time.Second
+
+	deviceCodeLength   = 32
+	userCodeCharset    = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength     = 8
+	slowDownIncrement  = 5 * time.Second
+	userCodeSeparation = userCodeLength / 2
+
+	// The verification page is locked for a remote host once it submitted too many invalid codes or passphrases
+	// during the window, so that the user codes cannot be guessed.
+	maxVerificationFailures    = 10
+	verificationFailuresWindow = time.Minute
+)
+
+var errDeviceWithoutConsent = errors.New("the device authorization grant requires the consent page, " +
+	"whose passphrase protects the device verification page")
+
+// DeviceConfig enables the device authorization grant, for machines without a browser.
+type DeviceConfig struct {
+	// CodeExp is the lifetime of the device and user codes. Defaults to DefaultDeviceCodeExp.
+	CodeExp time.Duration
+	// Interval is the minimum interval between two polls. Defaults to DefaultDeviceInterval.
+	Interval time.Duration
+}
+
+// DeviceAuthorizationResponse is the response of the device authorization endpoint.
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+type deviceStatus int
+
+const (
+	devicePending deviceStatus = iota
+	deviceDenied
+	deviceApproved
+	deviceIssued
+)
+
+type deviceGrant struct {
+	clientID  string
+	scope     string
+	userCode  string
+	expiresAt time.Time
+	interval  time.Duration
+	lastPoll  time.Time
+
+	status deviceStatus
+	token  oauth2.TokenInfo
+	err    error
+}
+
+// deviceGrants holds the pending device authorizations.
+type deviceGrants struct {
+	config *DeviceConfig
+
+	mutex        sync.Mutex
+	byDevice     map[string]*deviceGrant
+	deviceByUser map[string]string
+
+	// failures are counted per remote host, so that a client cannot lock out the others.
+	failures map[string]*verificationFailures
+}
+
+// verificationFailures counts the failed verifications of a remote host during the current window.
+type verificationFailures struct {
+	count int
+	since time.Time
+}
+
+func newDeviceGrants(config *DeviceConfig) *deviceGrants {
+	if config == nil {
+		return nil
+	}
+
+	config = &DeviceConfig{
+		CodeExp:  config.CodeExp,
+		Interval: config.Interval,
+	}
+
+	if config.CodeExp <= 0 {
+		config.CodeExp = DefaultDeviceCodeExp
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = DefaultDeviceInterval
+	}
+
+	return &deviceGrants{
+		config:       config,
+		mutex:        sync.Mutex{},
+		byDevice:     make(map[string]*deviceGrant),
+		deviceByUser: make(map[string]string),
+
+		failures: make(map[string]*verificationFailures),
+	}
+}
+
+// create registers a new pending authorization and returns its device code.
+func (g *deviceGrants) create(clientID, scope string) (string, *deviceGrant, error) {
+	deviceCode, err := randomString(deviceCodeLength)
+	if err != nil {
+		return "", nil, fmt.Errorf("generate device code: %w", err)
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.removeExpired()
+
+	var userCode string
+
+	for userCode == "" || g.deviceByUser[userCode] != "" {
+		userCode, err = randomUserCode()
+		if err != nil {
+			return "", nil, fmt.Errorf("generate user code: %w", err)
+		}
+	}
+
+	grant := &deviceGrant{
+		clientID:  clientID,
+		scope:     scope,
+		userCode:  userCode,
+		expiresAt: time.Now().Add(g.config.CodeExp),
+		interval:  g.config.Interval,
+		lastPoll:  time.Time{},
+		status:    devicePending,
+		token:     nil,
+		err:       nil,
+	}
+
+	g.byDevice[deviceCode] = grant
+	g.deviceByUser[userCode] = deviceCode
+
+	return deviceCode, grant, nil
+}
+
+// removeExpired must be called with the mutex held.
+func (g *deviceGrants) removeExpired() {
+	now := time.Now()
+
+	for deviceCode, grant := range g.byDevice {
+		if grant.expiresAt.Before(now) {
+			g.remove(deviceCode)
+		}
+	}
+}
+
+// remove must be called with the mutex held.
+func (g *deviceGrants) remove(deviceCode string) {
+	if grant, ok := g.byDevice[deviceCode]; ok {
+		delete(g.deviceByUser, grant.userCode)
+		delete(g.byDevice, deviceCode)
+	}
+}
+
+var (
+	errUnknownUserCode       = errors.New("unknown user code")
+	errTooManyVerifyAttempts = errors.New("too many verification attempts")
+)
+
+// pending returns the pending authorization of a user code.
+// Unknown codes count as failures of the remote host.
+func (g *deviceGrants) pending(remoteHost, userCode string) (*deviceGrant, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	_, grant, err := g.lookup(remoteHost, userCode)
+
+	return grant, err
+}
+
+// decide moves the pending authorization of a user code to the status, and returns its device code.
+// Only the first decision succeeds: the others find the authorization already decided.
+func (g *deviceGrants) decide(remoteHost, userCode string, status deviceStatus) (string, *deviceGrant, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	deviceCode, grant, err := g.lookup(remoteHost, userCode)
+	if err != nil {
+		return "", nil, err
+	}
+
+	grant.status = status
+
+	return deviceCode, grant, nil
+}
+
+// lookup must be called with the mutex held.
+func (g *deviceGrants) lookup(remoteHost, userCode string) (string, *deviceGrant, error) {
+	now := time.Now()
+
+	failures := g.failuresOf(remoteHost, now)
+	if failures.count >= maxVerificationFailures {
+		return "", nil, errTooManyVerifyAttempts
+	}
+
+	deviceCode, ok := g.deviceByUser[normalizeUserCode(userCode)]
+	if !ok {
+		failures.count++
+
+		return "", nil, errUnknownUserCode
+	}
+
+	grant := g.byDevice[deviceCode]
+	if grant.status != devicePending || grant.expiresAt.Before(now) {
+		failures.count++
+
+		return "", nil, errUnknownUserCode
+	}
+
+	return deviceCode, grant, nil
+}
+
+// clientID returns the client which requested the user code, whatever its status.
+// Unlike lookup, it does not count unknown codes as failures.
+func (g *deviceGrants) clientID(userCode string) string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if grant, ok := g.byDevice[g.deviceByUser[normalizeUserCode(userCode)]]; ok {
+		return grant.clientID
+	}
+
+	return ""
+}
+
+// fail records a failed verification of the remote host, such as an incorrect passphrase.
+func (g *deviceGrants) fail(remoteHost string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if failures := g.failuresOf(remoteHost, time.Now()); failures.count < maxVerificationFailures {
+		failures.count++
+	}
+}
+
+// failuresOf returns the failures of the remote host during the current window.
+// The windows which are over are forgotten. It must be called with the mutex held.
+func (g *deviceGrants) failuresOf(remoteHost string, now time.Time) *verificationFailures {
+	for host, failures := range g.failures {
+		if now.Sub(failures.since) > verificationFailuresWindow {
+			delete(g.failures, host)
+		}
+	}
+
+	failures, ok := g.failures[remoteHost]
+	if !ok {
+		failures = &verificationFailures{count: 0, since: now}
+		g.failures[remoteHost] = failures
+	}
+
+	return failures
+}
+
+func (g *deviceGrants) setResult(deviceCode string, token oauth2.TokenInfo, err error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if grant, ok := g.byDevice[deviceCode]; ok {
+		grant.status = deviceIssued
+		grant.token = token
+		grant.err = err
+	}
+}
+
+var (
+	errAuthorizationPending = errors.New("authorization_pending")
+	errSlowDown             = errors.New("slow_down")
+	errExpiredToken         = errors.New("expired_token")
+)
+
+// poll returns the token of an approved authorization, or the error to send to the device.
+func (g *deviceGrants) poll(deviceCode, clientID string) (oauth2.TokenInfo, error) { //nolint:ireturn
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	grant, ok := g.byDevice[deviceCode]
+	if !ok || grant.clientID != clientID {
+		return nil, oautherrs.ErrInvalidGrant
+	}
+
+	now := time.Now()
+
+	if grant.expiresAt.Before(now) {
+		g.remove(deviceCode)
+
+		return nil, errExpiredToken
+	}
+
+	// Requests sent at the expected interval may arrive slightly earlier.
+	if now.Sub(grant.lastPoll) < grant.interval*9/10 {
+		grant.interval += slowDownIncrement
+		grant.lastPoll = now
+
+		return nil, errSlowDown
+	}
+
+	grant.lastPoll = now
+
+	switch grant.status {
+	case devicePending, deviceApproved:
+		return nil, errAuthorizationPending
+
+	case deviceDenied:
+		g.remove(deviceCode)
+
+		return nil, oautherrs.ErrAccessDenied
+
+	case deviceIssued:
+		g.remove(deviceCode)
+
+		if grant.err != nil {
+			return nil, grant.err
+		}
+
+		return grant.token, nil
+	}
+
+	return nil, oautherrs.ErrServerError
+}
+
+func (e *endpoints) handleDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	client, err := e.authenticateClient(r)
+	if err != nil {
+		e.writeError(w, err)
+
+		return
+	}
+
+	scope, err := client.grantedScope(r.PostForm.Get("scope"), e.scopes)
+	if err != nil {
+		e.writeError(w, err)
+
+		return
+	}
+
+	deviceCode, grant, err := e.deviceGrants.create(client.GetID(), scope)
+	if err != nil {
+		e.logger.Printf("Failed to create device authorization: %v", err)
+		e.writeError(w, oautherrs.ErrServerError)
+
+		return
+	}
+
+	verificationURI := e.issuer() + DeviceVerificationPath
+
+	writeJSON(w, http.StatusOK, &DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                grant.userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {grant.userCode}}.Encode(),
+		ExpiresIn:               int64(e.deviceGrants.config.CodeExp / time.Second),
+		Interval:                int64(grant.interval / time.Second),
+	})
+}
+
+// handleDeviceToken answers the polling of a device on the token endpoint.
+// The client is authenticated by the token endpoint.
+func (e *endpoints) handleDeviceToken(w http.ResponseWriter, r *http.Request, client *Client) {
+	deviceCode := r.Form.Get("device_code")
+	if deviceCode == "" {
+		e.writeError(w, oautherrs.ErrInvalidRequest)
+
+		return
+	}
+
+	token, err := e.deviceGrants.poll(deviceCode, client.GetID())
+	if err != nil {
+		e.writeDeviceError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, e.oauthServer.GetTokenData(token))
+}
+
+func (e *endpoints) writeDeviceError(w http.ResponseWriter, err error) {
+	var description string
+
+	switch {
+	case errors.Is(err, errAuthorizationPending):
+		description = "The authorization request is still pending"
+	case errors.Is(err, errSlowDown):
+		description = "The device is polling too frequently"
+	case errors.Is(err, errExpiredToken):
+		description = "The device code has expired"
+	default:
+		e.writeError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusBadRequest, map[string]string{
+		"error":             err.Error(),
+		"error_description": description,
+	})
+}
+
+var deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Device authorization</title></head>
+<body>
+{{- if .Message }}
+<p><strong>{{ .Message }}</strong></p>
+{{- end }}
+{{- if .ClientID }}
+<form method="post">
+<p>The device <strong>{{ .ClientID }}</strong> requests access to Digiposte.</p>
+<input type="hidden" name="user_code" value="{{ .UserCode }}">
+<input type="hidden" name="device_token" value="{{ .Token }}">
+{{- if .PassphraseRequired }}
+<p><label>Passphrase: <input type="password" name="passphrase" autofocus></label></p>
+{{- end }}
+<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+{{- else if not .Done }}
+<form method="post">
+<label>Code displayed on the device: <input type="text" name="user_code" autofocus></label>
+<button type="submit">Continue</button>
+</form>
+{{- end }}
+</body>
+</html>
+`)) //nolint:gochecknoglobals
+
+type devicePage struct {
+	Message            string
+	Done               bool
+	ClientID           string
+	UserCode           string
+	Token              string
+	PassphraseRequired bool
+}
+
+// handleDeviceVerification lets an operator approve or deny a device.
+// The decisions are protected like the consent page: by a form token and the consent passphrase.
+func (e *endpoints) handleDeviceVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	page := &devicePage{
+		Message:            "",
+		Done:               false,
+		ClientID:           "",
+		UserCode:           "",
+		Token:              "",
+		PassphraseRequired: e.consent.passphrase != "",
+	}
+
+	status := http.StatusOK
+
+	if userCode := r.FormValue("user_code"); userCode != "" {
+		page.UserCode = normalizeUserCode(userCode)
+		status = e.verifyDevice(r, page)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The page must not be framed by another site to trick the operator into approving.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+
+	if err := deviceTemplate.Execute(w, page); err != nil {
+		e.logger.Printf("Failed to render device verification page: %v", err)
+	}
+}
+
+// verifyDevice shows the pending authorization of the user code, or applies the decision posted about it.
+// It returns the status of the page.
+func (e *endpoints) verifyDevice(r *http.Request, page *devicePage) int {
+	action := r.PostForm.Get("action")
+
+	if r.Method != http.MethodPost || action == "" {
+		grant, err := e.deviceGrants.pending(remoteHost(r), page.UserCode)
+		if err != nil {
+			return page.fail(err)
+		}
+
+		page.show(grant, e.consent.token(deviceFormParams(page.UserCode)))
+
+		return http.StatusOK
+	}
+
+	if !hmac.Equal([]byte(r.PostForm.Get("device_token")), []byte(e.consent.token(deviceFormParams(page.UserCode)))) {
+		page.Message = "The form has expired, please enter the code again."
+
+		return http.StatusForbidden
+	}
+
+	if action != "approve" {
+		if _, _, err := e.deviceGrants.decide(remoteHost(r), page.UserCode, deviceDenied); err != nil {
+			return page.fail(err)
+		}
+
+		page.Message, page.Done = "The device is denied.", true
+
+		return http.StatusOK
+	}
+
+	if !e.consent.validPassphrase(r.PostForm.Get("passphrase")) {
+		e.deviceGrants.fail(remoteHost(r))
+
+		grant, err := e.deviceGrants.pending(remoteHost(r), page.UserCode)
+		if err != nil {
+			return page.fail(err)
+		}
+
+		page.show(grant, r.PostForm.Get("device_token"))
+		page.Message = "The passphrase is incorrect."
+
+		return http.StatusForbidden
+	}
+
+	deviceCode, grant, err := e.deviceGrants.decide(remoteHost(r), page.UserCode, deviceApproved)
+	if err != nil {
+		return page.fail(err)
+	}
+
+	go e.issueDeviceToken(deviceCode, grant)
+
+	page.Message, page.Done = "The device is approved, you can return to it.", true
+
+	return http.StatusOK
+}
+
+// remoteHost identifies the client of the request to count its failed verifications.
+// The forwarding headers are ignored, as the client could choose them.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// deviceFormParams are the parameters the form token of the verification page is bound to.
+func deviceFormParams(userCode string) url.Values {
+	return url.Values{"user_code": {userCode}}
+}
+
+func (p *devicePage) show(grant *deviceGrant, token string) {
+	p.ClientID = grant.clientID
+	p.Token = token
+}
+
+// fail describes the lookup error and returns the status of the page.
+func (p *devicePage) fail(err error) int {
+	p.UserCode = ""
+
+	if errors.Is(err, errTooManyVerifyAttempts) {
+		p.Message, p.Done = "Too many attempts, please try again later.", true
+
+		return http.StatusTooManyRequests
+	}
+
+	p.Message = "This code is invalid or has expired."
+
+	return http.StatusNotFound
+}
+
+// issueDeviceToken logs in to Digiposte for an approved device.
+func (e *endpoints) issueDeviceToken(deviceCode string, grant *deviceGrant) {
+	ctx, cancel := context.WithDeadline(context.Background(), grant.expiresAt)
+	defer cancel()
+
+	info, err := e.manager.GetClient(ctx, grant.clientID)
+	if err != nil {
+		e.deviceGrants.setResult(deviceCode, nil, err)
+
+		return
+	}
+
+	token, err := e.issueToken(ctx, info, grant.clientID, grant.scope)
+	if err != nil {
+		e.logger.Printf("Failed to issue a token to device of %q: %v", grant.clientID, err)
+
+		err = oautherrs.ErrAccessDenied
+	}
+
+	e.deviceGrants.setResult(deviceCode, token, err)
+}
+
+// issueToken generates and stores a token outside of the grants handled by the manager.
+// It uses the same lifetimes as the authorization code grant.
+func (e *endpoints) issueToken( //nolint:ireturn
+	ctx context.Context,
+	client oauth2.ClientInfo,
+	userID, scope string,
+) (oauth2.TokenInfo, error) {
+	tokenConfig := manage.DefaultAuthorizeCodeTokenCfg
+	createdAt := time.Now()
+
+	token := models.NewToken()
+	token.SetClientID(client.GetID())
+	token.SetUserID(userID)
+	token.SetScope(scope)
+	token.SetAccessCreateAt(createdAt)
+	token.SetAccessExpiresIn(tokenConfig.AccessTokenExp)
+	token.SetRefreshCreateAt(createdAt)
+	token.SetRefreshExpiresIn(tokenConfig.RefreshTokenExp)
+
+	access, refresh, err := e.accessGenerator.Token(ctx, &oauth2.GenerateBasic{
+		Client:    client,
+		UserID:    userID,
+		CreateAt:  createdAt,
+		TokenInfo: token,
+		Request:   nil,
+	}, true)
+	if err != nil {
+		return nil, fmt.Errorf("generate: %w", err)
+	}
+
+	token.SetAccess(access)
+	token.SetRefresh(refresh)
+
+	if err := e.tokenStore.Create(ctx, token); err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+
+	return token, nil
+}
+
+func randomString(length int) (string, error) {
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// randomUserCode returns a code easy to type, such as "BDFG-HJKL".
+func randomUserCode() (string, error) {
+	var builder strings.Builder
+
+	charsetLength := big.NewInt(int64(len(userCodeCharset)))
+
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeSeparation {
+			builder.WriteByte('-')
+		}
+
+		index, err := rand.Int(rand.Reader, charsetLength)
+		if err != nil {
+			return "", fmt.Errorf("read random: %w", err)
+		}
+
+		builder.WriteByte(userCodeCharset[index.Int64()])
+	}
+
+	return builder.String(), nil
+}
+
+// normalizeUserCode accepts codes typed in lower case or without the separator.
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(userCode), "-", ""))
+
+	if len(userCode) != userCodeLength {
+		return userCode
+	}
+
+	return userCode[:userCodeSeparation] + "-" + userCode[userCodeSeparation:]
+}
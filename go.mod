@@ -12,7 +12,9 @@ require (
 	github.com/onsi/ginkgo/v2 v2.13.0
 	github.com/onsi/gomega v1.30.0
 	github.com/pquerna/otp v1.4.0
+	golang.org/x/crypto v0.14.0
 	golang.org/x/oauth2 v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -55,5 +57,4 @@ require (
 	golang.org/x/tools v0.14.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
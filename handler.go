@@ -0,0 +1,365 @@
+package digipoauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4/generates"
+	digiconfig "github.com/holyhope/digiposte-oauth/config"
+)
+
+// Handler serves the oauth endpoints, to be mounted in an existing web service.
+// The listeners, TLS and lifecycle are left to the host application, which must Close it once done.
+type Handler struct {
+	handler         http.Handler
+	clientStore     ClientStore
+	accessGenerator *AccessGenerator
+	pathPrefix      string
+	clientsFile     *clientsFileWatcher
+	consent         *consentPage
+	secretHashCost  int
+	auditLog        *auditLog
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+var (
+	errMissingIssuer = errors.New("the issuer is required, as the Host header of the requests cannot be trusted")
+	errNoClientsFile = errors.New("no clients file is configured")
+)
+
+// NewHandler creates the handler of the oauth endpoints. It requires Config.Issuer.
+// The fields of the configuration related to the listeners and TLS are ignored.
+func NewHandler(setter digiconfig.Setter, config *Config) (*Handler, error) {
+	return newHandler(setter, config, nil)
+}
+
+// newHandler creates the handler of the oauth endpoints, also reached by the clients under the base URLs.
+func newHandler(setter digiconfig.Setter, config *Config, baseURLs []string) (*Handler, error) {
+	if config.Issuer == "" {
+		return nil, errMissingIssuer
+	}
+
+	// The issuer comes first, the other URLs are only accepted as audiences of the client assertions.
+	issuers := []string{strings.TrimSuffix(config.Issuer, "/")}
+
+	for _, baseURL := range baseURLs {
+		if !stringsContain(issuers, baseURL) {
+			issuers = append(issuers, baseURL)
+		}
+	}
+
+	pathPrefix := strings.TrimSuffix(config.PathPrefix, "/")
+
+	clientStore := config.ClientStore
+	if clientStore == nil {
+		clientStore = NewMemoryClientStore()
+	}
+
+	tokenStore := config.TokenStore
+	if tokenStore == nil {
+		memoryStore, err := NewMemoryTokenStore()
+		if err != nil {
+			return nil, fmt.Errorf("token store: %w", err)
+		}
+
+		tokenStore = memoryStore
+	}
+
+	logger := config.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	getter := config.Getter
+	if getter == nil {
+		getter = emptyGetter
+	}
+
+	audit, err := newAuditLog(config.Audit, logger)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+
+	accessGenerator := &AccessGenerator{
+		setter:      setter,
+		getter:      getter,
+		loginMethod: config.LoginMethod,
+		logins:      newLoginGroup(config.LoginMethod, audit),
+		credentials: &sync.Map{},
+		sessions:    &sync.Map{},
+		relogins:    &sync.Map{},
+		logger:      logger,
+		refresher:   nil,
+		cache:       newTokenCache(config.TokenCache),
+
+		expiryMargin: DefaultTokenExpiryMargin,
+	}
+
+	if config.TokenExpiryMargin > 0 {
+		accessGenerator.expiryMargin = config.TokenExpiryMargin
+	}
+
+	accessGenerator.refresher = newRefresher(accessGenerator, config.Refresher)
+
+	handler := &Handler{
+		handler:         nil,
+		clientStore:     clientStore,
+		accessGenerator: accessGenerator,
+		pathPrefix:      pathPrefix,
+		clientsFile:     nil,
+		consent:         nil,
+		secretHashCost:  config.SecretHashCost,
+		auditLog:        audit,
+	}
+
+	// What was opened or started is closed if the handler cannot be created.
+	created := false
+
+	defer func() {
+		if !created {
+			handler.Close()
+		}
+	}()
+
+	var keys *keySet
+
+	if config.JWT != nil {
+		var err error
+
+		keys, err = newKeySet(config.JWT)
+		if err != nil {
+			return nil, fmt.Errorf("signing keys: %w", err)
+		}
+
+		accessGenerator.signer = &accessTokenSigner{keys: keys, issuer: issuers[0]}
+	}
+
+	if accessGenerator.cache != nil && keys == nil {
+		return nil, errTokenCacheWithoutJWT
+	}
+
+	manager := newManager(&enabledClientStore{ClientStore: clientStore}, tokenStore, accessGenerator)
+
+	var openID *openIDProvider
+
+	if config.OpenID {
+		if keys == nil {
+			return nil, errOpenIDWithoutJWT
+		}
+
+		subjectKey, err := loadSubjectKey(config.JWT.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("subject key: %w", err)
+		}
+
+		openID = newOpenIDProvider(keys, issuers[0], subjectKey)
+		accessGenerator.openID = openID
+
+		manager.MapAuthorizeGenerate(&openIDAuthorizeGenerate{
+			AuthorizeGenerate: generates.NewAuthorizeGenerate(),
+			provider:          openID,
+		})
+	}
+
+	consent, err := newConsentPage(config.Consent, accessGenerator, logger)
+	if err != nil {
+		return nil, fmt.Errorf("consent: %w", err)
+	}
+
+	if config.Device != nil && consent == nil {
+		return nil, errDeviceWithoutConsent
+	}
+
+	scopes := serverScopes(config.OpenID)
+
+	oauthServer := newOAuthServer(manager, config.Server, consent, scopes)
+	if openID != nil {
+		oauthServer.ExtensionFieldsHandler = openID.extensionFields
+	}
+
+	mux, err := newMux(&endpoints{
+		oauthServer:            oauthServer,
+		manager:                manager,
+		tokenStore:             tokenStore,
+		accessGenerator:        accessGenerator,
+		logger:                 logger,
+		clientStore:            clientStore,
+		secretHashCost:         config.SecretHashCost,
+		deviceGrants:           newDeviceGrants(config.Device),
+		assertions:             newAssertionVerifier(),
+		keys:                   keys,
+		openID:                 openID,
+		scopes:                 scopes,
+		auditLog:               audit,
+		consent:                consent,
+		introspectionClients:   config.IntrospectionClients,
+		revokeDigiposteSession: config.RevokeDigiposteSession,
+		proxy:                  config.Proxy,
+		pathPrefix:             pathPrefix,
+		issuers:                issuers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	handler.handler = mux
+	handler.consent = consent
+
+	var watcher *clientsFileWatcher
+
+	if config.ClientsFile != nil {
+		// The clients removed from the file are deleted from the store.
+		if _, err := handler.managedClientStore(); err != nil {
+			return nil, fmt.Errorf("clients file: %w", err)
+		}
+
+		watcher = newClientsFileWatcher(handler, config.ClientsFile)
+		if err := watcher.reload(context.Background(), true); err != nil {
+			// As on reload, the valid entries are applied and the invalid ones are only reported.
+			var fileErr *ClientsFileError
+			if !errors.As(err, &fileErr) {
+				return nil, fmt.Errorf("clients file: %w", err)
+			}
+
+			logger.Printf("Failed to apply the clients file: %v", err)
+		}
+	}
+
+	if config.Admin != nil {
+		adminHandler, err := handler.newAdminHandler(config.Admin)
+		if err != nil {
+			return nil, err
+		}
+
+		mux.Handle(AdminPath, adminHandler)
+		mux.Handle(AdminPath+"/", adminHandler)
+	}
+
+	if pathPrefix != "" {
+		handler.handler = http.StripPrefix(pathPrefix, mux)
+	}
+
+	// The watcher starts last, as nothing can fail after it.
+	if watcher != nil {
+		handler.clientsFile = watcher
+
+		go watcher.watch(logger)
+	}
+
+	created = true
+
+	return handler, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r)
+}
+
+// ReloadClientsFile applies the clients file again, even if it did not change.
+// Invalid entries are reported as a *ClientsFileError and leave the corresponding clients unchanged.
+func (h *Handler) ReloadClientsFile(ctx context.Context) error {
+	if h.clientsFile == nil {
+		return errNoClientsFile
+	}
+
+	return h.clientsFile.reload(ctx, true)
+}
+
+// Close stops the background work of the handler.
+func (h *Handler) Close() {
+	if h.clientsFile != nil {
+		h.clientsFile.close()
+	}
+
+	if h.accessGenerator.refresher != nil {
+		h.accessGenerator.refresher.stop()
+	}
+
+	if err := h.auditLog.close(); err != nil {
+		h.accessGenerator.logger.Printf("Failed to close the audit log: %v", err)
+	}
+}
+
+// RegisterUser adds a user to the handler.
+// Options such as WithPublicClient or WithPKCERequired customize the registered client.
+func (h *Handler) RegisterUser(
+	clientID, clientSecret, redirectURL, username, password, otpSecret string,
+	opts ...Option,
+) error {
+	client := &Client{
+		ID:           clientID,
+		Secret:       clientSecret,
+		UserID:       clientID,
+		Public:       false,
+		Domain:       redirectURL,
+		SecretHash:   "",
+		RedirectURIs: []string{redirectURL},
+		APIURL:       "",
+		DocumentURL:  "",
+		PKCERequired: false,
+		Disabled:     false,
+		AuthMethods:  nil,
+		PublicKeys:   nil,
+		Scopes:       nil,
+
+		TokensNotBefore: time.Time{},
+		FromClientsFile: false,
+	}
+
+	for i, opt := range opts {
+		if err := opt.Apply(client); err != nil {
+			return fmt.Errorf("apply option %d: %w", i, err)
+		}
+	}
+
+	if err := validateClient(client); err != nil {
+		return err
+	}
+
+	if err := client.setSecret(clientSecret, h.secretHashCost); err != nil {
+		return &InvalidClientError{ClientID: clientID, Err: err}
+	}
+
+	return h.applyClient(client, &Credentials{
+		Username:  username,
+		Password:  password,
+		OTPSecret: otpSecret,
+	})
+}
+
+// applyClient stores the client and its credentials.
+// The Digiposte session is dropped if the credentials changed. The revoked tokens stay revoked.
+// A new client rejects the tokens issued earlier, which may be left by a deleted client of the same ID.
+func (h *Handler) applyClient(client *Client, creds *Credentials) error {
+	existing, err := h.clientStore.GetByID(context.Background(), client.ID)
+	if err != nil {
+		return fmt.Errorf("get client: %w", err)
+	}
+
+	if client.TokensNotBefore.IsZero() {
+		if existing != nil {
+			client.TokensNotBefore = toClient(existing).TokensNotBefore
+		} else {
+			client.TokensNotBefore = time.Now()
+		}
+	}
+
+	if err := h.clientStore.Set(client.ID, client); err != nil {
+		return fmt.Errorf("set client: %w", err)
+	}
+
+	if current, ok := h.accessGenerator.Credentials(client.ID); ok && *current != *creds {
+		h.accessGenerator.forgetSession(client.ID)
+	}
+
+	h.accessGenerator.SetCredentials(client.ID, creds)
+
+	return nil
+}
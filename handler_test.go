@@ -0,0 +1,149 @@
+package digipoauth_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4/server"
+	digipoauth "github.com/holyhope/digiposte-oauth"
+	configfakes "github.com/holyhope/digiposte-oauth/config/configfakes"
+	. "github.com/onsi/ginkgo/v2" //nolint:revive
+	. "github.com/onsi/gomega"    //nolint:revive
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Handler", func() {
+	var (
+		hostServer *httptest.Server
+		handler    *digipoauth.Handler
+		cfg        *oauth2.Config
+	)
+
+	BeforeEach(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/callback", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		hostServer = httptest.NewServer(mux)
+		DeferCleanup(hostServer.Close)
+
+		var err error
+
+		handler, err = digipoauth.NewHandler(&configfakes.FakeSetter{}, &digipoauth.Config{
+			Server:     server.NewConfig(),
+			PathPrefix: "/oauth/",
+			Issuer:     hostServer.URL + "/oauth",
+			LoginMethod: digipoauth.LoginMethodFunc(
+				func(context.Context, *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+					return &oauth2.Token{
+						AccessToken:  "access-token",
+						TokenType:    "token-type",
+						RefreshToken: "",
+						Expiry:       time.Now().Add(time.Hour),
+					}, nil, nil
+				},
+			),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(handler.Close)
+
+		mux.Handle("/oauth/", handler)
+
+		Expect(handler.RegisterUser(
+			ClientID, ClientSecret, hostServer.URL+"/callback",
+			Username, Password, OTPSecret,
+		)).To(Succeed())
+
+		cfg = &oauth2.Config{
+			ClientID:     ClientID,
+			ClientSecret: ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:       hostServer.URL + "/oauth" + digipoauth.AuthorizePath,
+				TokenURL:      hostServer.URL + "/oauth" + digipoauth.TokenPath,
+				AuthStyle:     oauth2.AuthStyleInParams,
+				DeviceAuthURL: "",
+			},
+			RedirectURL: hostServer.URL + "/callback",
+			Scopes:      nil,
+		}
+	})
+
+	authorize := func() string {
+		var code string
+
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, _ []*http.Request) error {
+				code = req.URL.Query().Get("code")
+
+				return http.ErrUseLastResponse
+			},
+		}
+
+		resp, err := client.Get(cfg.AuthCodeURL("tests")) //nolint:noctx
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(code).ToNot(BeEmpty())
+
+		return code
+	}
+
+	It("Should serve the endpoints under the path prefix", func(ctx SpecContext) {
+		token, err := cfg.Exchange(ctx, authorize())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token.AccessToken).To(Equal("access-token"))
+	})
+
+	It("Should accept the client assertions addressed to the issuer", func() {
+		const JWTClientID = "jwt-client-id"
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(handler.RegisterUser(
+			JWTClientID, "", hostServer.URL+"/callback",
+			Username, Password, OTPSecret,
+			&digipoauth.WithPublicKeys{Keys: []string{
+				string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: nil, Bytes: der})),
+			}},
+		)).To(Succeed())
+
+		cfg.ClientID = JWTClientID
+
+		resp, err := http.PostForm(cfg.Endpoint.TokenURL, url.Values{ //nolint:noctx
+			"grant_type":            {"authorization_code"},
+			"code":                  {authorize()},
+			"redirect_uri":          {cfg.RedirectURL},
+			"client_assertion_type": {digipoauth.ClientAssertionType},
+			"client_assertion":      {signAssertion(key, JWTClientID, cfg.Endpoint.TokenURL)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("Should advertise the prefixed endpoints", func() {
+		resp, err := http.Get(hostServer.URL + "/oauth" + digipoauth.MetadataPath) //nolint:noctx
+		Expect(err).ToNot(HaveOccurred())
+
+		defer resp.Body.Close()
+
+		var metadata digipoauth.AuthorizationServerMetadata
+		Expect(json.NewDecoder(resp.Body).Decode(&metadata)).To(Succeed())
+
+		Expect(metadata.Issuer).To(Equal(hostServer.URL + "/oauth"))
+		Expect(metadata.TokenEndpoint).To(Equal(cfg.Endpoint.TokenURL))
+	})
+})
@@ -0,0 +1,146 @@
+package digipoauth
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
+)
+
+// IntrospectionPath is the path to the token introspection endpoint (RFC 7662).
+const IntrospectionPath = "/introspect"
+
+// IntrospectionResponse describes a token as specified by RFC 7662.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// handleIntrospection describes a token to an authenticated confidential client.
+// Username is the Digiposte account the token gives access to.
+// Unless the client is one of the introspection clients, the tokens of the other clients are reported as inactive.
+func (e *endpoints) handleIntrospection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	client, err := e.authenticateClient(r)
+	if err != nil {
+		e.writeError(w, err)
+
+		return
+	}
+
+	// Public clients cannot authenticate, they are not allowed to learn about tokens.
+	if client.IsPublic() {
+		e.writeError(w, oautherrs.ErrUnauthorizedClient)
+
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		e.writeError(w, oautherrs.ErrInvalidRequest)
+
+		return
+	}
+
+	info, err := e.loadToken(r.Context(), token, r.PostForm.Get("token_type_hint"))
+	if err != nil {
+		e.logger.Printf("Failed to load token to introspect: %v", err)
+		e.writeError(w, oautherrs.ErrServerError)
+
+		return
+	}
+
+	if info != nil && info.GetClientID() != client.GetID() && !e.mayIntrospect(client.GetID()) {
+		info = nil
+	}
+
+	writeJSON(w, http.StatusOK, e.introspect(r.Context(), info, token))
+}
+
+// mayIntrospect reports whether the client may introspect the tokens of the other clients.
+func (e *endpoints) mayIntrospect(clientID string) bool {
+	for _, allowed := range e.introspectionClients {
+		if allowed == clientID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *endpoints) introspect(ctx context.Context, info oauth2.TokenInfo, token string) *IntrospectionResponse {
+	inactive := &IntrospectionResponse{
+		Active:    false,
+		ClientID:  "",
+		Username:  "",
+		Subject:   "",
+		Scope:     "",
+		TokenType: "",
+		ExpiresAt: 0,
+		IssuedAt:  0,
+	}
+
+	if info == nil {
+		return inactive
+	}
+
+	response := &IntrospectionResponse{
+		Active:    true,
+		ClientID:  info.GetClientID(),
+		Username:  "",
+		Subject:   info.GetUserID(),
+		Scope:     info.GetScope(),
+		TokenType: "",
+		ExpiresAt: 0,
+		IssuedAt:  0,
+	}
+
+	var createdAt time.Time
+
+	var expiresIn time.Duration
+
+	if info.GetAccess() == token {
+		response.TokenType = e.oauthServer.Config.TokenType
+		createdAt, expiresIn = info.GetAccessCreateAt(), info.GetAccessExpiresIn()
+	} else {
+		response.TokenType = "refresh_token"
+		createdAt, expiresIn = info.GetRefreshCreateAt(), info.GetRefreshExpiresIn()
+	}
+
+	// The tokens of the deleted and disabled clients are not active anymore.
+	if _, err := e.tokenClient(ctx, info, createdAt); err != nil {
+		return inactive
+	}
+
+	response.IssuedAt = createdAt.Unix()
+
+	// A zero duration means the token never expires.
+	if expiresIn > 0 {
+		expiresAt := createdAt.Add(expiresIn)
+		if expiresAt.Before(time.Now()) {
+			return inactive
+		}
+
+		response.ExpiresAt = expiresAt.Unix()
+	}
+
+	if creds, ok := e.accessGenerator.Credentials(info.GetClientID()); ok {
+		response.Username = creds.Username
+	}
+
+	return response
+}
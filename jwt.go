@@ -0,0 +1,325 @@
+package digipoauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// JWKSPath is the path to the JSON Web Key Set verifying the tokens signed by the server.
+	JWKSPath = "/.well-known/jwks.json"
+	// SigningKeysFile is the name of the file persisting the signing keys in JWTConfig.Dir.
+	SigningKeysFile = "signing-keys.json"
+
+	// DefaultKeyRotationInterval is the default interval at which a new signing key is generated.
+	DefaultKeyRotationInterval = 24 * time.Hour
+	// DefaultRetiredKeyLifetime is the default duration for which a replaced key is still published.
+	DefaultRetiredKeyLifetime = 24 * time.Hour
+
+	// AccessTokenJWTType is the typ header of the access tokens, as specified by RFC 9068.
+	AccessTokenJWTType = "at+jwt"
+	// JWTSigningAlgorithm is the algorithm of the tokens signed by the server.
+	JWTSigningAlgorithm = "ES256"
+)
+
+// JWTConfig configures the signed JWT access tokens. Zero values are replaced by the defaults.
+type JWTConfig struct {
+	// Dir is where the signing keys are persisted, so that the issued tokens survive a restart.
+	// So is the key of the OpenID Connect subjects. The keys live in memory if it is empty.
+	Dir string
+	// RotationInterval is the interval at which a new signing key is generated.
+	RotationInterval time.Duration
+	// RetiredKeyLifetime is the duration for which a replaced key is still published,
+	// so that the tokens it signed can be verified until they expire.
+	RetiredKeyLifetime time.Duration
+}
+
+// JSONWebKey is a public key of the key set, as specified by RFC 7517.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JSONWebKeySet is the response of the JWKS endpoint.
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+// signingKey is a key of the key set.
+type signingKey struct {
+	id        string
+	key       *ecdsa.PrivateKey
+	createdAt time.Time
+}
+
+// storedKey is a signing key as persisted in SigningKeysFile.
+type storedKey struct {
+	ID         string    `json:"kid"`
+	PrivateKey []byte    `json:"private_key"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// keySet holds the signing keys. The newest one signs, the others are only published until they retire.
+type keySet struct {
+	path               string
+	rotationInterval   time.Duration
+	retiredKeyLifetime time.Duration
+	now                func() time.Time
+
+	mutex sync.Mutex
+	keys  []*signingKey
+}
+
+func newKeySet(config *JWTConfig) (*keySet, error) {
+	keys := &keySet{
+		path:               "",
+		rotationInterval:   config.RotationInterval,
+		retiredKeyLifetime: config.RetiredKeyLifetime,
+		now:                time.Now,
+		mutex:              sync.Mutex{},
+		keys:               nil,
+	}
+
+	if keys.rotationInterval <= 0 {
+		keys.rotationInterval = DefaultKeyRotationInterval
+	}
+
+	if keys.retiredKeyLifetime <= 0 {
+		keys.retiredKeyLifetime = DefaultRetiredKeyLifetime
+	}
+
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0o700); err != nil { //nolint:gomnd
+			return nil, fmt.Errorf("create %q: %w", config.Dir, err)
+		}
+
+		keys.path = filepath.Join(config.Dir, SigningKeysFile)
+
+		if err := keys.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := keys.current(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// current returns the key signing the new tokens, rotating the keys if it is too old.
+func (s *keySet) current() (*signingKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+
+	if len(s.keys) > 0 && now.Sub(s.keys[0].createdAt) < s.rotationInterval {
+		return s.keys[0], nil
+	}
+
+	key, err := newSigningKey(now)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*signingKey{key}
+
+	// A key retires when it is replaced, which is when the next one was created.
+	retiredAt := now
+
+	for _, previous := range s.keys {
+		if now.Sub(retiredAt) < s.retiredKeyLifetime {
+			keys = append(keys, previous)
+		}
+
+		retiredAt = previous.createdAt
+	}
+
+	if err := s.save(keys); err != nil {
+		return nil, err
+	}
+
+	s.keys = keys
+
+	return key, nil
+}
+
+// publicKeys returns the key set to publish, including the retired keys.
+func (s *keySet) publicKeys() (*JSONWebKeySet, error) {
+	if _, err := s.current(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	set := &JSONWebKeySet{Keys: make([]*JSONWebKey, 0, len(s.keys))}
+
+	for _, key := range s.keys {
+		set.Keys = append(set.Keys, publicJWK(key))
+	}
+
+	return set, nil
+}
+
+// sign signs the claims with the current key.
+func (s *keySet) sign(jwtType string, claims interface{}) (string, error) {
+	key, err := s.current()
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(&jwtHeader{Algorithm: JWTSigningAlgorithm, KeyID: key.id, Type: jwtType})
+	if err != nil {
+		return "", fmt.Errorf("marshal header: %w", err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("marshal claims: %w", err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	r, sig, err := ecdsa.Sign(rand.Reader, key.key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+
+	// ES256 signatures are the concatenation of r and s, each on 32 bytes.
+	signature := make([]byte, 64) //nolint:gomnd
+	r.FillBytes(signature[:32])
+	sig.FillBytes(signature[32:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (s *keySet) load() error {
+	content, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("read %q: %w", s.path, err)
+	}
+
+	var stored []*storedKey
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return fmt.Errorf("unmarshal %q: %w", s.path, err)
+	}
+
+	for _, entry := range stored {
+		key, err := x509.ParseECPrivateKey(entry.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("parse key %q: %w", entry.ID, err)
+		}
+
+		s.keys = append(s.keys, &signingKey{id: entry.ID, key: key, createdAt: entry.CreatedAt})
+	}
+
+	return nil
+}
+
+// save persists the keys, unless they live in memory.
+func (s *keySet) save(keys []*signingKey) error {
+	if s.path == "" {
+		return nil
+	}
+
+	stored := make([]*storedKey, 0, len(keys))
+
+	for _, key := range keys {
+		der, err := x509.MarshalECPrivateKey(key.key)
+		if err != nil {
+			return fmt.Errorf("marshal key %q: %w", key.id, err)
+		}
+
+		stored = append(stored, &storedKey{ID: key.id, PrivateKey: der, CreatedAt: key.createdAt})
+	}
+
+	content, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal keys: %w", err)
+	}
+
+	return writeFileAtomic(s.path, content)
+}
+
+func newSigningKey(createdAt time.Time) (*signingKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate signing key: %w", err)
+	}
+
+	signing := &signingKey{id: "", key: key, createdAt: createdAt}
+	signing.id = thumbprint(publicJWK(signing))
+
+	return signing, nil
+}
+
+func publicJWK(key *signingKey) *JSONWebKey {
+	const coordinateSize = 32
+
+	x := make([]byte, coordinateSize)
+	y := make([]byte, coordinateSize)
+
+	key.key.X.FillBytes(x)
+	key.key.Y.FillBytes(y)
+
+	return &JSONWebKey{
+		KeyType:   "EC",
+		Curve:     "P-256",
+		X:         base64.RawURLEncoding.EncodeToString(x),
+		Y:         base64.RawURLEncoding.EncodeToString(y),
+		KeyID:     key.id,
+		Use:       "sig",
+		Algorithm: JWTSigningAlgorithm,
+	}
+}
+
+// thumbprint is the JWK thumbprint of the key, as specified by RFC 7638.
+func thumbprint(jwk *JSONWebKey) string {
+	digest := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Curve, jwk.KeyType, jwk.X, jwk.Y)))
+
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+func (e *endpoints) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	keys, err := e.keys.publicKeys()
+	if err != nil {
+		e.logger.Printf("Failed to publish the signing keys: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, keys)
+}
@@ -0,0 +1,317 @@
+package digipoauth
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// TCPNetwork is the network of the TCP listeners.
+	TCPNetwork = "tcp"
+	// UnixNetwork is the network of the Unix domain socket listeners.
+	UnixNetwork = "unix"
+
+	// DefaultUnixSocketMode is the default file mode of the Unix domain sockets, only reachable by their owner.
+	DefaultUnixSocketMode os.FileMode = 0o600
+)
+
+// ListenerConfig declares an address the server listens on.
+type ListenerConfig struct {
+	// Network is either TCPNetwork or UnixNetwork.
+	Network string
+	// Addr is the TCP address or the path of the Unix domain socket.
+	Addr string
+	// Mode is the file mode of the Unix domain socket. Defaults to DefaultUnixSocketMode.
+	Mode os.FileMode
+
+	// Listener is an already opened listener. Network and Addr are ignored when set.
+	Listener net.Listener
+}
+
+var (
+	errUnsupportedNetwork = errors.New("unsupported network")
+	errNotSocket          = errors.New("the path exists and is not a socket")
+	errSocketInUse        = errors.New("the socket is in use")
+)
+
+// listenAll opens the listeners, closing the already opened ones on failure.
+func listenAll(configs []*ListenerConfig) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(configs))
+
+	for i, config := range configs {
+		listener, err := listen(config)
+		if err != nil {
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+
+			return nil, fmt.Errorf("listener %d: %w", i, err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+func listen(config *ListenerConfig) (net.Listener, error) {
+	if config.Listener != nil {
+		return config.Listener, nil
+	}
+
+	switch config.Network {
+	case TCPNetwork:
+		listener, err := net.Listen(TCPNetwork, config.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("listen: %w", err)
+		}
+
+		return listener, nil
+
+	case UnixNetwork:
+		return listenUnix(config.Addr, config.Mode)
+
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnsupportedNetwork, config.Network)
+	}
+}
+
+// listenUnix creates the socket in a private directory, where it is only reachable by its owner
+// until its mode is set, then moves it to its path.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".socket-")
+	if err != nil {
+		return nil, fmt.Errorf("create private directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	privatePath := filepath.Join(dir, filepath.Base(path))
+
+	listener, err := net.ListenUnix(UnixNetwork, &net.UnixAddr{Name: privatePath, Net: UnixNetwork})
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	// The socket is removed from its final path on close.
+	listener.SetUnlinkOnClose(false)
+
+	if mode == 0 {
+		mode = DefaultUnixSocketMode
+	}
+
+	if err := os.Chmod(privatePath, mode); err != nil {
+		_ = listener.Close()
+
+		return nil, fmt.Errorf("chmod: %w", err)
+	}
+
+	if err := os.Rename(privatePath, path); err != nil {
+		_ = listener.Close()
+
+		return nil, fmt.Errorf("move socket: %w", err)
+	}
+
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// removeStaleSocket makes room for the socket, which would otherwise replace whatever is at its path.
+// Only a socket left by a previous run that did not shut down cleanly is removed: nobody accepts connections on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err != nil:
+		return fmt.Errorf("stat socket: %w", err)
+	case info.Mode()&os.ModeSocket == 0:
+		return fmt.Errorf("%w: %q", errNotSocket, path)
+	}
+
+	if conn, err := net.Dial(UnixNetwork, path); err == nil {
+		_ = conn.Close()
+
+		return fmt.Errorf("%w: %q", errSocketInUse, path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+
+	return nil
+}
+
+// unixListener is a listener whose socket was moved to path after being created.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: UnixNetwork}
+}
+
+func (l *unixListener) Close() error {
+	if err := l.UnixListener.Close(); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove socket: %w", err)
+	}
+
+	return nil
+}
+
+// tcpAddrs returns the addresses of the TCP listeners to open.
+func tcpAddrs(configs []*ListenerConfig) []string {
+	addrs := make([]string, 0, len(configs))
+
+	for _, config := range configs {
+		if config.Listener == nil && config.Network == TCPNetwork {
+			addrs = append(addrs, config.Addr)
+		}
+	}
+
+	return addrs
+}
+
+// ListenerURLs gives the URLs of the endpoints as reached through one of the listeners of the server.
+type ListenerURLs struct {
+	// Network is the network of the listener, such as TCPNetwork or UnixNetwork.
+	Network string
+	// Addr is the address the listener is bound to.
+	Addr string
+
+	base string
+}
+
+func newListenerURLs(listener net.Listener, tls bool, pathPrefix string) *ListenerURLs {
+	addr := listener.Addr()
+
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+
+	host := addr.String()
+
+	// Unix domain sockets follow the convention of the http+unix scheme: the escaped path is the host.
+	if addr.Network() == UnixNetwork {
+		scheme += "+unix"
+		host = url.PathEscape(host)
+	}
+
+	return &ListenerURLs{
+		Network: addr.Network(),
+		Addr:    addr.String(),
+		base:    scheme + "://" + host + pathPrefix,
+	}
+}
+
+// BaseURL returns the URL under which the endpoints are served.
+func (u *ListenerURLs) BaseURL() string {
+	return u.base
+}
+
+// AuthorizeURL returns the URL to the authorize endpoint.
+func (u *ListenerURLs) AuthorizeURL() string {
+	return u.base + AuthorizePath
+}
+
+// TokenURL returns the URL to the token endpoint.
+func (u *ListenerURLs) TokenURL() string {
+	return u.base + TokenPath
+}
+
+// MetadataURL returns the URL to the authorization server metadata.
+func (u *ListenerURLs) MetadataURL() string {
+	return u.base + MetadataPath
+}
+
+// RevocationURL returns the URL to the token revocation endpoint.
+func (u *ListenerURLs) RevocationURL() string {
+	return u.base + RevocationPath
+}
+
+// IntrospectionURL returns the URL to the token introspection endpoint.
+func (u *ListenerURLs) IntrospectionURL() string {
+	return u.base + IntrospectionPath
+}
+
+// APIProxyURL returns the URL of the proxy to the Digiposte API.
+func (u *ListenerURLs) APIProxyURL() string {
+	return u.base + APIProxyPath
+}
+
+// DocumentProxyURL returns the URL of the proxy to the Digiposte document server.
+func (u *ListenerURLs) DocumentProxyURL() string {
+	return u.base + DocumentProxyPath
+}
+
+// DeviceAuthorizationURL returns the URL to the device authorization endpoint.
+func (u *ListenerURLs) DeviceAuthorizationURL() string {
+	return u.base + DeviceAuthorizationPath
+}
+
+// JWKSURL returns the URL to the key set verifying the signed tokens.
+func (u *ListenerURLs) JWKSURL() string {
+	return u.base + JWKSPath
+}
+
+// UserInfoURL returns the URL to the OpenID Connect userinfo endpoint.
+func (u *ListenerURLs) UserInfoURL() string {
+	return u.base + UserInfoPath
+}
+
+// URLs returns the URLs of the endpoints for each listener, in the order of the configuration.
+func (s *Server) URLs() []*ListenerURLs {
+	urls := make([]*ListenerURLs, 0, len(s.listeners))
+
+	for _, listener := range s.listeners {
+		urls = append(urls, newListenerURLs(listener, s.tls, s.pathPrefix))
+	}
+
+	return urls
+}
+
+// defaultURLs returns the URLs of the default listener.
+func (s *Server) defaultURLs() *ListenerURLs {
+	return newListenerURLs(defaultListener(s.listeners), s.tls, s.pathPrefix)
+}
+
+// defaultListener returns the first TCP listener, or the first listener if none is a TCP one.
+func defaultListener(listeners []net.Listener) net.Listener { //nolint:ireturn
+	for _, listener := range listeners {
+		if listener.Addr().Network() == TCPNetwork {
+			return listener
+		}
+	}
+
+	return listeners[0]
+}
+
+// listenerBaseURLs returns the base URLs of the endpoints through each of the listeners,
+// starting with the default one.
+func listenerBaseURLs(listeners []net.Listener, tls bool, pathPrefix string) []string {
+	base := defaultListener(listeners)
+	baseURLs := []string{newListenerURLs(base, tls, pathPrefix).BaseURL()}
+
+	for _, listener := range listeners {
+		if listener != base {
+			baseURLs = append(baseURLs, newListenerURLs(listener, tls, pathPrefix).BaseURL())
+		}
+	}
+
+	return baseURLs
+}
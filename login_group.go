@@ -0,0 +1,170 @@
+package digipoauth
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// loginGroup coalesces the concurrent logins and session renewals with the same credentials into a single call
+// of the login method, so that Digiposte does not see several logins of the same account at once.
+type loginGroup struct {
+	loginMethod LoginMethod
+	auditLog    *auditLog
+
+	mutex sync.Mutex
+	calls map[Credentials]*loginCall
+}
+
+// loginCall is a login in flight, shared by all the callers waiting for it.
+type loginCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+
+	token   *oauth2.Token
+	cookies []*http.Cookie
+	err     error
+}
+
+func newLoginGroup(loginMethod LoginMethod, audit *auditLog) *loginGroup {
+	return &loginGroup{
+		loginMethod: loginMethod,
+		auditLog:    audit,
+		mutex:       sync.Mutex{},
+		calls:       make(map[Credentials]*loginCall),
+	}
+}
+
+// login joins the login or renewal in flight with the same credentials, or starts a login.
+// Each caller stops waiting when its context is done; the login itself is cancelled once nobody waits for it.
+func (g *loginGroup) login(ctx context.Context, creds *Credentials) (*oauth2.Token, []*http.Cookie, error) {
+	return g.join(ctx, *creds, func(ctx context.Context, creds *Credentials) (*oauth2.Token, []*http.Cookie, error) {
+		start := time.Now()
+
+		token, cookies, err := g.loginMethod.Login(ctx, creds)
+
+		g.auditLog.recordLogin(AuditActionLogin, creds, start, err)
+
+		return token, cookies, err //nolint:wrapcheck
+	})
+}
+
+// renew joins the login or renewal in flight with the same credentials, or starts renewing the session
+// from its cookies.
+func (g *loginGroup) renew(
+	ctx context.Context,
+	renewer SessionRenewer,
+	creds *Credentials,
+	cookies []*http.Cookie,
+) (*oauth2.Token, []*http.Cookie, error) {
+	return g.join(ctx, *creds, func(ctx context.Context, creds *Credentials) (*oauth2.Token, []*http.Cookie, error) {
+		start := time.Now()
+
+		token, renewed, err := renewer.Renew(ctx, creds, cookies)
+
+		g.auditLog.recordLogin(AuditActionRenew, creds, start, err)
+
+		return token, renewed, err //nolint:wrapcheck
+	})
+}
+
+// loginFunc logs in to Digiposte, or renews a session.
+type loginFunc func(ctx context.Context, creds *Credentials) (*oauth2.Token, []*http.Cookie, error)
+
+// join waits for the call in flight with the same credentials, or starts one running fn.
+func (g *loginGroup) join(
+	ctx context.Context,
+	creds Credentials,
+	fn loginFunc,
+) (*oauth2.Token, []*http.Cookie, error) {
+	g.mutex.Lock()
+
+	call, ok := g.calls[creds]
+	if !ok {
+		call = g.start(creds, fn)
+	}
+
+	call.waiters++
+
+	g.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return nil, nil, call.err
+		}
+
+		cookies := append([]*http.Cookie(nil), call.cookies...)
+
+		if call.token == nil {
+			return nil, cookies, nil
+		}
+
+		// Each caller gets its own copy, which it may modify.
+		token := *call.token
+
+		return &token, cookies, nil
+
+	case <-ctx.Done():
+		g.leave(creds, call)
+
+		return nil, nil, ctx.Err() //nolint:wrapcheck
+	}
+}
+
+// start runs fn in the background, detached from the context of the caller which started it.
+// It must be called with the mutex held.
+func (g *loginGroup) start(creds Credentials, fn loginFunc) *loginCall {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	call := &loginCall{
+		done:    make(chan struct{}),
+		cancel:  cancel,
+		waiters: 0,
+		token:   nil,
+		cookies: nil,
+		err:     nil,
+	}
+
+	g.calls[creds] = call
+
+	go func() {
+		defer cancel()
+
+		call.token, call.cookies, call.err = fn(ctx, &creds)
+
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+
+		if g.calls[creds] == call {
+			delete(g.calls, creds)
+		}
+
+		close(call.done)
+	}()
+
+	return call
+}
+
+// leave stops waiting for the login, which is cancelled if it was the last caller waiting for it.
+func (g *loginGroup) leave(creds Credentials, call *loginCall) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	call.waiters--
+
+	if call.waiters > 0 {
+		return
+	}
+
+	call.cancel()
+
+	// The next caller starts a new login instead of joining the cancelled one.
+	if g.calls[creds] == call {
+		delete(g.calls, creds)
+	}
+}
@@ -0,0 +1,143 @@
+package digipoauth
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-oauth2/oauth2/v4"
+)
+
+const (
+	// MetadataPath is the path to the authorization server metadata (RFC 8414).
+	MetadataPath = "/.well-known/oauth-authorization-server"
+	// OpenIDConfigurationPath is the OpenID Connect discovery alias of MetadataPath.
+	OpenIDConfigurationPath = "/.well-known/openid-configuration"
+)
+
+// AuthorizationServerMetadata describes the server as specified by RFC 8414.
+type AuthorizationServerMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported,omitempty"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
+
+	RevocationEndpoint                     string   `json:"revocation_endpoint,omitempty"`
+	RevocationEndpointAuthMethodsSupported []string `json:"revocation_endpoint_auth_methods_supported,omitempty"`
+
+	IntrospectionEndpoint                     string   `json:"introspection_endpoint,omitempty"`
+	IntrospectionEndpointAuthMethodsSupported []string `json:"introspection_endpoint_auth_methods_supported,omitempty"`
+
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint,omitempty"`
+
+	JWKSURI string `json:"jwks_uri,omitempty"`
+
+	// The OpenID Connect discovery fields, set when Config.OpenID is.
+	UserInfoEndpoint                 string   `json:"userinfo_endpoint,omitempty"`
+	SubjectTypesSupported            []string `json:"subject_types_supported,omitempty"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported,omitempty"`
+	ClaimsSupported                  []string `json:"claims_supported,omitempty"`
+}
+
+// newMetadata builds the metadata from the configuration actually enforced by the oauth server.
+func newMetadata(issuer string, e *endpoints) *AuthorizationServerMetadata {
+	config := e.oauthServer.Config
+
+	metadata := &AuthorizationServerMetadata{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + AuthorizePath,
+		TokenEndpoint:                     issuer + TokenPath,
+		ResponseTypesSupported:            make([]string, 0, len(config.AllowedResponseTypes)),
+		GrantTypesSupported:               make([]string, 0, len(config.AllowedGrantTypes)),
+		TokenEndpointAuthMethodsSupported: authMethodNames(AuthMethods),
+		CodeChallengeMethodsSupported:     make([]string, 0, len(config.AllowedCodeChallengeMethods)),
+		ScopesSupported:                   e.scopes,
+
+		TokenEndpointAuthSigningAlgValuesSupported: AssertionSigningAlgorithms,
+
+		RevocationEndpoint:                     issuer + RevocationPath,
+		RevocationEndpointAuthMethodsSupported: authMethodNames(AuthMethods),
+
+		IntrospectionEndpoint: issuer + IntrospectionPath,
+		// Public clients are not allowed to introspect tokens.
+		IntrospectionEndpointAuthMethodsSupported: authMethodNames([]AuthMethod{
+			AuthMethodClientSecretBasic, AuthMethodClientSecretPost, AuthMethodPrivateKeyJWT,
+		}),
+
+		DeviceAuthorizationEndpoint: "",
+
+		JWKSURI: "",
+
+		UserInfoEndpoint:                 "",
+		SubjectTypesSupported:            nil,
+		IDTokenSigningAlgValuesSupported: nil,
+		ClaimsSupported:                  nil,
+	}
+
+	for _, responseType := range config.AllowedResponseTypes {
+		metadata.ResponseTypesSupported = append(metadata.ResponseTypesSupported, responseType.String())
+
+		if responseType == oauth2.Token {
+			metadata.GrantTypesSupported = append(metadata.GrantTypesSupported, "implicit")
+		}
+	}
+
+	for _, grantType := range config.AllowedGrantTypes {
+		// The password grant is always denied: credentials are those of Digiposte, not of this server.
+		if grantType == oauth2.PasswordCredentials {
+			continue
+		}
+
+		metadata.GrantTypesSupported = append(metadata.GrantTypesSupported, grantType.String())
+	}
+
+	if e.deviceGrants != nil {
+		metadata.DeviceAuthorizationEndpoint = issuer + DeviceAuthorizationPath
+		metadata.GrantTypesSupported = append(metadata.GrantTypesSupported, DeviceCodeGrantType)
+	}
+
+	if e.keys != nil {
+		metadata.JWKSURI = issuer + JWKSPath
+	}
+
+	if e.openID != nil {
+		metadata.UserInfoEndpoint = issuer + UserInfoPath
+		metadata.SubjectTypesSupported = []string{"public"}
+		metadata.IDTokenSigningAlgValuesSupported = []string{JWTSigningAlgorithm}
+		metadata.ClaimsSupported = []string{
+			"iss", "sub", "aud", "azp", "exp", "iat", "auth_time", "nonce", "at_hash",
+			"preferred_username", "name", "given_name", "family_name", "email",
+		}
+	}
+
+	for _, method := range config.AllowedCodeChallengeMethods {
+		metadata.CodeChallengeMethodsSupported = append(metadata.CodeChallengeMethodsSupported, method.String())
+	}
+
+	return metadata
+}
+
+func (e *endpoints) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	// The Host header is chosen by the client, the URLs it discovers must not be.
+	writeJSON(w, http.StatusOK, newMetadata(e.issuer(), e))
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(value) //nolint:errchkjson
+}
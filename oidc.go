@@ -0,0 +1,415 @@
+package digipoauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/holyhope/digiposte-go-sdk/v1"
+)
+
+const (
+	// ScopeOpenID asks for an ID token, as specified by OpenID Connect.
+	ScopeOpenID = "openid"
+	// ScopeProfile adds the name of the user to the ID token and the user info.
+	ScopeProfile = "profile"
+	// ScopeEmail adds the email address of the user to the ID token and the user info, when the login is one.
+	ScopeEmail = "email"
+
+	// UserInfoPath is the path to the OpenID Connect userinfo endpoint.
+	UserInfoPath = "/userinfo"
+	// SubjectKeyFile is the name of the file persisting the key of the subject identifiers in JWTConfig.Dir.
+	SubjectKeyFile = "subject-key"
+
+	subjectKeyLength = 32
+	// IDTokenJWTType is the typ header of the ID tokens.
+	IDTokenJWTType = "JWT"
+)
+
+// OpenIDScopes are the scopes of the OpenID Connect layer.
+var OpenIDScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail} //nolint:gochecknoglobals
+
+var errOpenIDWithoutJWT = errors.New("OpenID Connect requires JWT, whose keys sign the ID tokens")
+
+// IDTokenClaims are the claims of the ID tokens. The subject identifies the Digiposte account.
+type IDTokenClaims struct {
+	Issuer          string `json:"iss"`
+	Subject         string `json:"sub"`
+	Audience        string `json:"aud"`
+	AuthorizedParty string `json:"azp"`
+	ExpiresAt       int64  `json:"exp"`
+	IssuedAt        int64  `json:"iat"`
+	AuthTime        int64  `json:"auth_time,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+	AccessTokenHash string `json:"at_hash,omitempty"`
+
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+}
+
+// UserInfo is the response of the userinfo endpoint, built from the Digiposte profile.
+type UserInfo struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name              string `json:"name,omitempty"`
+	GivenName         string `json:"given_name,omitempty"`
+	FamilyName        string `json:"family_name,omitempty"`
+	Email             string `json:"email,omitempty"`
+}
+
+// openIDProvider issues the ID tokens. They are signed along with the access token,
+// then added to the token response by the oauth server.
+type openIDProvider struct {
+	keys       *keySet
+	issuer     string
+	subjectKey []byte
+	now        func() time.Time
+
+	mutex          sync.Mutex
+	authorizations map[string]*openIDAuthorization
+	idTokens       map[string]*pendingIDToken
+}
+
+// openIDAuthorization is what the ID token tells about the authorization request, kept until its code is exchanged.
+type openIDAuthorization struct {
+	nonce     string
+	authTime  time.Time
+	expiresAt time.Time
+}
+
+// pendingIDToken is an ID token waiting to be added to the response of its access token.
+type pendingIDToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+func newOpenIDProvider(keys *keySet, issuer string, subjectKey []byte) *openIDProvider {
+	return &openIDProvider{
+		keys:           keys,
+		issuer:         issuer,
+		subjectKey:     subjectKey,
+		now:            time.Now,
+		mutex:          sync.Mutex{},
+		authorizations: make(map[string]*openIDAuthorization),
+		idTokens:       make(map[string]*pendingIDToken),
+	}
+}
+
+// requestsOpenID reports whether the scope asks for an ID token.
+func requestsOpenID(scope string) bool {
+	return stringsContain(strings.Fields(scope), ScopeOpenID)
+}
+
+// openIDAuthorizeGenerate generates the authorization codes,
+// remembering the nonce of the requests asking for an ID token.
+type openIDAuthorizeGenerate struct {
+	oauth2.AuthorizeGenerate
+
+	provider *openIDProvider
+}
+
+func (g *openIDAuthorizeGenerate) Token(ctx context.Context, data *oauth2.GenerateBasic) (string, error) {
+	code, err := g.AuthorizeGenerate.Token(ctx, data)
+	if err != nil {
+		return "", err //nolint:wrapcheck
+	}
+
+	if info := data.TokenInfo; info != nil && data.Request != nil && requestsOpenID(info.GetScope()) {
+		g.provider.authorize(code, &openIDAuthorization{
+			nonce:     data.Request.FormValue("nonce"),
+			authTime:  data.CreateAt,
+			expiresAt: info.GetCodeCreateAt().Add(info.GetCodeExpiresIn()),
+		})
+	}
+
+	return code, nil
+}
+
+func (p *openIDProvider) authorize(code string, authorization *openIDAuthorization) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.purge()
+
+	p.authorizations[code] = authorization
+}
+
+// issue signs the ID token of the access token, which is handed out with the token response.
+func (p *openIDProvider) issue(
+	ctx context.Context,
+	generateBasic *oauth2.GenerateBasic,
+	accessToken string,
+	creds *Credentials,
+) error {
+	if creds == nil {
+		return ErrNilCredentials
+	}
+
+	info := generateBasic.TokenInfo
+	createdAt := info.GetAccessCreateAt()
+	expiresAt := createdAt.Add(info.GetAccessExpiresIn())
+
+	// The access token hash is the left half of its SHA-256, as specified for ES256.
+	digest := sha256.Sum256([]byte(accessToken))
+
+	claims := &IDTokenClaims{
+		Issuer:            p.issuer,
+		Subject:           p.subject(creds),
+		Audience:          generateBasic.Client.GetID(),
+		AuthorizedParty:   generateBasic.Client.GetID(),
+		ExpiresAt:         expiresAt.Unix(),
+		IssuedAt:          createdAt.Unix(),
+		AuthTime:          0,
+		Nonce:             "",
+		AccessTokenHash:   base64.RawURLEncoding.EncodeToString(digest[:len(digest)/2]),
+		PreferredUsername: "",
+		Email:             "",
+	}
+
+	// The tokens issued to devices or refreshed were not authorized with a nonce.
+	if request := generateBasic.Request; request != nil && request.FormValue("grant_type") == "authorization_code" {
+		if authorization, ok := p.takeAuthorization(request.FormValue("code")); ok {
+			claims.Nonce = authorization.nonce
+			claims.AuthTime = authorization.authTime.Unix()
+		}
+	}
+
+	scopes := strings.Fields(info.GetScope())
+
+	if stringsContain(scopes, ScopeProfile) {
+		claims.PreferredUsername = creds.Username
+	}
+
+	if stringsContain(scopes, ScopeEmail) {
+		claims.Email = emailAddress(creds.Username)
+	}
+
+	idToken, err := p.keys.sign(IDTokenJWTType, claims)
+	if err != nil {
+		return fmt.Errorf("sign ID token: %w", err)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.purge()
+
+	p.idTokens[accessToken] = &pendingIDToken{token: idToken, expiresAt: expiresAt}
+
+	return nil
+}
+
+func (p *openIDProvider) takeAuthorization(code string) (*openIDAuthorization, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	authorization, ok := p.authorizations[code]
+	delete(p.authorizations, code)
+
+	return authorization, ok
+}
+
+// extensionFields adds the ID token to the response of the access token it was issued with.
+func (p *openIDProvider) extensionFields(info oauth2.TokenInfo) map[string]interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pending, ok := p.idTokens[info.GetAccess()]
+	if !ok {
+		return nil
+	}
+
+	delete(p.idTokens, info.GetAccess())
+
+	return map[string]interface{}{"id_token": pending.token}
+}
+
+// purge drops the authorizations and ID tokens which expired before being used.
+// It must be called with the mutex held.
+func (p *openIDProvider) purge() {
+	now := p.now()
+
+	for code, authorization := range p.authorizations {
+		if now.After(authorization.expiresAt) {
+			delete(p.authorizations, code)
+		}
+	}
+
+	for accessToken, pending := range p.idTokens {
+		if now.After(pending.expiresAt) {
+			delete(p.idTokens, accessToken)
+		}
+	}
+}
+
+// subject identifies the Digiposte account without disclosing its login.
+// It is keyed, so that it cannot be computed from the email address of the user.
+func (p *openIDProvider) subject(creds *Credentials) string {
+	mac := hmac.New(sha256.New, p.subjectKey)
+	mac.Write([]byte(strings.ToLower(creds.Username)))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// loadSubjectKey reads the key of the subject identifiers from the directory, generating it on first use.
+// It lives in memory if the directory is empty, so the subjects then change on restart.
+func loadSubjectKey(dir string) ([]byte, error) {
+	if dir == "" {
+		return newSubjectKey()
+	}
+
+	path := filepath.Join(dir, SubjectKeyFile)
+
+	key, err := os.ReadFile(path)
+	if err == nil {
+		return key, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read %q: %w", path, err)
+	}
+
+	key, err = newSubjectKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return key, writeFileAtomic(path, key)
+}
+
+func newSubjectKey() ([]byte, error) {
+	key := make([]byte, subjectKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	return key, nil
+}
+
+func (e *endpoints) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	var creds *Credentials
+
+	token, client, err := e.bearerClient(r)
+	if err == nil {
+		creds, _ = e.accessGenerator.Credentials(client.ID)
+	}
+
+	if creds == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+		return
+	}
+
+	if !requestsOpenID(token.GetScope()) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, ScopeOpenID))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+		return
+	}
+
+	profile, err := e.profile(r.Context(), client)
+	if err != nil {
+		e.logger.Printf("Failed to get the profile of %q: %v", client.ID, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newUserInfo(e.openID.subject(creds), creds, profile, token.GetScope()))
+}
+
+// profile fetches the Digiposte profile with the session of the client.
+// It logs in again and retries once when Digiposte rejects the session.
+func (e *endpoints) profile(ctx context.Context, client *Client) (*digiposte.Profile, error) {
+	getter := client.getter(e.accessGenerator.getter)
+
+	current, err := e.accessGenerator.session(ctx, client.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := current.profile(ctx, getter)
+
+	var requestErr *digiposte.RequestError
+	if !errors.As(err, &requestErr) {
+		return profile, err
+	}
+
+	renewed, err := e.accessGenerator.relogin(ctx, client.ID, current)
+	if err != nil {
+		return nil, err
+	}
+
+	return renewed.profile(ctx, getter)
+}
+
+// newUserInfo returns the claims of the profile granted by the scope.
+// The login is used when the profile does not tell the username.
+// As in the ID token, the email address is the login of the account, when it is one.
+func newUserInfo(subject string, creds *Credentials, profile *digiposte.Profile, scope string) *UserInfo {
+	userInfo := &UserInfo{
+		Subject:           subject,
+		PreferredUsername: "",
+		Name:              "",
+		GivenName:         "",
+		FamilyName:        "",
+		Email:             "",
+	}
+
+	scopes := strings.Fields(scope)
+
+	if stringsContain(scopes, ScopeProfile) {
+		userInfo.PreferredUsername = firstNonEmpty(profile.UserInfo.Login, creds.Username)
+		userInfo.GivenName = profile.UserInfo.FirstName
+		userInfo.FamilyName = profile.UserInfo.LastName
+		userInfo.Name = strings.TrimSpace(profile.UserInfo.FirstName + " " + profile.UserInfo.LastName)
+	}
+
+	if stringsContain(scopes, ScopeEmail) {
+		userInfo.Email = emailAddress(creds.Username)
+	}
+
+	return userInfo
+}
+
+// emailAddress returns the login of a Digiposte account if it is an email address, or an empty string.
+// The address is not claimed verified: it is only the login the account was configured with.
+func emailAddress(login string) string {
+	address, err := mail.ParseAddress(login)
+	if err != nil || address.Address != login {
+		return ""
+	}
+
+	return login
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,204 @@
+package digipoauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	digiconfig "github.com/holyhope/digiposte-oauth/config"
+)
+
+const (
+	// APIProxyPath is the path under which the requests are forwarded to the Digiposte API.
+	APIProxyPath = "/api/"
+	// DocumentProxyPath is the path under which the requests are forwarded to the Digiposte document server.
+	DocumentProxyPath = "/documents/"
+)
+
+// proxyClientKey is the context key of the client whose Digiposte session authenticates a forwarded request.
+type proxyClientKey struct{}
+
+// proxyTargetKey is the context key of the URL a request is forwarded to.
+type proxyTargetKey struct{}
+
+// newProxy forwards the requests under prefix to the URL of the given configuration key,
+// with the Digiposte session of the calling client. The client authenticates with an access token issued by this server.
+func (e *endpoints) newProxy(prefix, targetKey string) (http.Handler, error) {
+	// Clients may override the URL, the default one is checked once for all.
+	if _, err := proxyTarget(e.accessGenerator.getter, targetKey); err != nil {
+		return nil, err
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			targetURL, _ := req.Context().Value(proxyTargetKey{}).(*url.URL)
+
+			req.URL.Scheme = targetURL.Scheme
+			req.URL.Host = targetURL.Host
+			req.URL.Path = singleJoiningSlash(targetURL.Path, strings.TrimPrefix(req.URL.Path, prefix))
+			req.URL.RawPath = ""
+			req.Host = targetURL.Host
+
+			// The credentials of the caller are meant for this server, not for Digiposte.
+			req.Header.Del("Authorization")
+			req.Header.Del("Cookie")
+		},
+		Transport: &proxyTransport{
+			accessGenerator: e.accessGenerator,
+			base:            http.DefaultTransport,
+		},
+		FlushInterval:  0,
+		ErrorLog:       e.logger,
+		BufferPool:     nil,
+		ModifyResponse: nil,
+		ErrorHandler:   nil,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, client, err := e.bearerClient(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+			return
+		}
+
+		required := RequiredScope(targetKey, r.Method, strings.TrimPrefix(r.URL.Path, prefix))
+		if !HasScope(token.GetScope(), required) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, required))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+			return
+		}
+
+		targetURL, err := proxyTarget(client.getter(e.accessGenerator.getter), targetKey)
+		if err != nil {
+			e.logger.Printf("Failed to proxy the request of %q: %v", client.ID, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), proxyClientKey{}, client.ID)
+		ctx = context.WithValue(ctx, proxyTargetKey{}, targetURL)
+
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	}), nil
+}
+
+func proxyTarget(getter digiconfig.Getter, key string) (*url.URL, error) {
+	target := digiconfig.APIURL(getter)
+	if key == digiconfig.DocumentURLKey {
+		target = digiconfig.DocumentURL(getter)
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, &InvalidProxyTargetError{Target: target, Err: err}
+	}
+
+	return targetURL, nil
+}
+
+// proxyTransport authenticates the forwarded requests with the Digiposte session of the client.
+// It logs in again and retries once when Digiposte rejects the session.
+type proxyTransport struct {
+	accessGenerator *AccessGenerator
+	base            http.RoundTripper
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	clientID, _ := req.Context().Value(proxyClientKey{}).(string)
+
+	current, err := t.accessGenerator.session(req.Context(), clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.send(req, current)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The body of the request has been consumed by the first attempt.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+
+	renewed, err := t.accessGenerator.relogin(req.Context(), clientID, current)
+	if err != nil {
+		t.accessGenerator.logger.Printf("Failed to log %q in again: %v", clientID, err)
+
+		return resp, nil
+	}
+
+	_ = resp.Body.Close()
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	return t.send(req, renewed)
+}
+
+func (t *proxyTransport) send(req *http.Request, current *session) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	current.authenticate(req)
+
+	return t.base.RoundTrip(req) //nolint:wrapcheck
+}
+
+func singleJoiningSlash(a, b string) string {
+	aSlash := strings.HasSuffix(a, "/")
+	bSlash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case !aSlash && !bSlash:
+		return a + "/" + b
+	}
+
+	return a + b
+}
+
+// InvalidProxyTargetError is returned when the Digiposte URL to proxy cannot be parsed.
+type InvalidProxyTargetError struct {
+	Target string
+	Err    error
+}
+
+func (e *InvalidProxyTargetError) Error() string {
+	return fmt.Sprintf("invalid proxy target %q: %v", e.Target, e.Err)
+}
+
+func (e *InvalidProxyTargetError) Unwrap() error {
+	return e.Err
+}
+
+// handleProxies registers the proxies to the Digiposte API and document server.
+func (e *endpoints) handleProxies(mux *http.ServeMux) error {
+	for prefix, targetKey := range map[string]string{
+		APIProxyPath:      digiconfig.APIURLKey,
+		DocumentProxyPath: digiconfig.DocumentURLKey,
+	} {
+		proxy, err := e.newProxy(prefix, targetKey)
+		if err != nil {
+			return err
+		}
+
+		mux.Handle(prefix, proxy)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package digipoauth
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRefreshBefore is the default delay before the expiry at which the token is refreshed.
+	DefaultRefreshBefore = 5 * time.Minute
+	// DefaultRefreshJitter is the default maximum random delay subtracted from the refresh time.
+	DefaultRefreshJitter = time.Minute
+	// DefaultMaxConcurrentLogins is the default number of logins running at the same time in the background.
+	DefaultMaxConcurrentLogins = 1
+)
+
+// RefresherConfig configures the background worker logging in again before the Digiposte tokens expire.
+// Zero values are replaced by the defaults.
+type RefresherConfig struct {
+	// Before is the delay before the expiry at which the login is run.
+	Before time.Duration
+	// Jitter is the maximum random delay added before Before, so that logins do not all run at once.
+	Jitter time.Duration
+	// MaxConcurrentLogins bounds the number of logins running at the same time.
+	MaxConcurrentLogins int
+}
+
+// refresher logs in again shortly before the Digiposte tokens expire,
+// so that the next token request is served from the warm result instead of waiting for a login.
+type refresher struct {
+	accessGenerator *AccessGenerator
+	before          time.Duration
+	jitter          time.Duration
+	semaphore       chan struct{}
+
+	ctx    context.Context //nolint:containedctx // Cancelled when the server shuts down.
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mutex  sync.Mutex
+	timers map[string]*time.Timer
+	warm   map[string]*session
+}
+
+func newRefresher(accessGenerator *AccessGenerator, config *RefresherConfig) *refresher {
+	if config == nil {
+		return nil
+	}
+
+	before := config.Before
+	if before <= 0 {
+		before = DefaultRefreshBefore
+	}
+
+	jitter := config.Jitter
+	if jitter <= 0 {
+		jitter = DefaultRefreshJitter
+	}
+
+	maxConcurrentLogins := config.MaxConcurrentLogins
+	if maxConcurrentLogins <= 0 {
+		maxConcurrentLogins = DefaultMaxConcurrentLogins
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &refresher{
+		accessGenerator: accessGenerator,
+		before:          before,
+		jitter:          jitter,
+		semaphore:       make(chan struct{}, maxConcurrentLogins),
+		ctx:             ctx,
+		cancel:          cancel,
+		wg:              sync.WaitGroup{},
+		mutex:           sync.Mutex{},
+		timers:          make(map[string]*time.Timer),
+		warm:            make(map[string]*session),
+	}
+}
+
+// track schedules the login of the client before the expiry of its Digiposte token.
+func (r *refresher) track(clientID string, expiry time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if timer, ok := r.timers[clientID]; ok {
+		timer.Stop()
+		delete(r.timers, clientID)
+	}
+
+	if expiry.IsZero() || r.ctx.Err() != nil {
+		return
+	}
+
+	delay := time.Until(expiry) - r.before - time.Duration(rand.Int63n(int64(r.jitter))) //nolint:gosec
+	if delay < 0 {
+		delay = 0
+	}
+
+	r.timers[clientID] = time.AfterFunc(delay, func() {
+		r.refresh(clientID)
+	})
+}
+
+func (r *refresher) refresh(clientID string) {
+	// Registering under the lock ensures stop does not miss a login starting concurrently.
+	r.mutex.Lock()
+
+	if r.ctx.Err() != nil {
+		r.mutex.Unlock()
+
+		return
+	}
+
+	r.wg.Add(1)
+	r.mutex.Unlock()
+
+	defer r.wg.Done()
+
+	select {
+	case <-r.ctx.Done():
+		return
+	case r.semaphore <- struct{}{}:
+	}
+
+	defer func() { <-r.semaphore }()
+
+	creds, ok := r.accessGenerator.Credentials(clientID)
+	if !ok {
+		return
+	}
+
+	token, cookies, ok := r.accessGenerator.renew(r.ctx, clientID, creds)
+	if !ok {
+		var err error
+
+		token, cookies, err = r.accessGenerator.logins.login(r.ctx, creds)
+		if err != nil {
+			r.accessGenerator.logger.Printf("Failed to refresh the token of %q in the background: %v", clientID, err)
+
+			return
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.timers, clientID)
+
+	r.warm[clientID] = &session{
+		Token:   token,
+		Cookies: cookies,
+	}
+}
+
+// take returns the warm session of the client, if it is still valid. It can only be taken once.
+func (r *refresher) take(clientID string) (*session, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	warm, ok := r.warm[clientID]
+	if !ok {
+		return nil, false
+	}
+
+	delete(r.warm, clientID)
+
+	if !warm.Token.Valid() {
+		return nil, false
+	}
+
+	return warm, true
+}
+
+// forget stops refreshing the token of the client.
+func (r *refresher) forget(clientID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if timer, ok := r.timers[clientID]; ok {
+		timer.Stop()
+		delete(r.timers, clientID)
+	}
+
+	delete(r.warm, clientID)
+}
+
+// stop cancels the pending logins and waits for the running ones.
+func (r *refresher) stop() {
+	r.mutex.Lock()
+
+	r.cancel()
+
+	for clientID, timer := range r.timers {
+		timer.Stop()
+		delete(r.timers, clientID)
+	}
+
+	r.mutex.Unlock()
+
+	r.wg.Wait()
+}
@@ -0,0 +1,118 @@
+package digipoauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
+)
+
+// RevocationPath is the path to the token revocation endpoint (RFC 7009).
+const RevocationPath = "/revoke"
+
+// handleRevocation removes both the access and the refresh tokens of a grant.
+// Unknown tokens are ignored, as required by RFC 7009.
+func (e *endpoints) handleRevocation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	client, err := e.authenticateClient(r)
+	if err != nil {
+		e.writeError(w, err)
+
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		e.writeError(w, oautherrs.ErrInvalidRequest)
+
+		return
+	}
+
+	info, err := e.loadToken(r.Context(), token, r.PostForm.Get("token_type_hint"))
+	if err != nil {
+		e.logger.Printf("Failed to load token to revoke: %v", err)
+		e.writeError(w, oautherrs.ErrServerError)
+
+		return
+	}
+
+	if info == nil {
+		w.WriteHeader(http.StatusOK)
+
+		return
+	}
+
+	if info.GetClientID() != client.GetID() {
+		e.writeError(w, oautherrs.ErrUnauthorizedClient)
+
+		return
+	}
+
+	if err := e.removeToken(r.Context(), info); err != nil {
+		e.logger.Printf("Failed to revoke token: %v", err)
+		e.writeError(w, oautherrs.ErrServerError)
+
+		return
+	}
+
+	// Unless the access tokens are signed, the Digiposte token is the revoked one: it must not be issued again.
+	e.accessGenerator.invalidateCache(client.GetID())
+
+	if e.revokeDigiposteSession {
+		// The token is already revoked locally, so a failure to end the Digiposte session is not reported.
+		if err := e.accessGenerator.endSession(r.Context(), client.GetID(), client.getter(e.accessGenerator.getter)); err != nil {
+			e.logger.Printf("Failed to end the Digiposte session of %q: %v", client.GetID(), err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// loadToken looks up a token by its value, starting with the type given by the hint.
+func (e *endpoints) loadToken(ctx context.Context, token, hint string) (oauth2.TokenInfo, error) { //nolint:ireturn
+	lookups := []func(context.Context, string) (oauth2.TokenInfo, error){
+		e.tokenStore.GetByAccess,
+		e.tokenStore.GetByRefresh,
+	}
+
+	if hint == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+
+	for _, lookup := range lookups {
+		info, err := lookup(ctx, token)
+		if err != nil {
+			return nil, fmt.Errorf("lookup: %w", err)
+		}
+
+		if info != nil && (info.GetAccess() == token || info.GetRefresh() == token) {
+			return info, nil
+		}
+	}
+
+	return nil, nil //nolint:nilnil
+}
+
+func (e *endpoints) removeToken(ctx context.Context, info oauth2.TokenInfo) error {
+	if access := info.GetAccess(); access != "" {
+		if err := e.tokenStore.RemoveByAccess(ctx, access); err != nil {
+			return fmt.Errorf("remove access token: %w", err)
+		}
+	}
+
+	if refresh := info.GetRefresh(); refresh != "" {
+		if err := e.tokenStore.RemoveByRefresh(ctx, refresh); err != nil {
+			return fmt.Errorf("remove refresh token: %w", err)
+		}
+	}
+
+	return nil
+}
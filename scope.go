@@ -0,0 +1,200 @@
+package digipoauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
+	digiconfig "github.com/holyhope/digiposte-oauth/config"
+)
+
+// The scopes a client may request, each one granting a Digiposte capability.
+const (
+	// ScopeDocumentsRead lists, searches and downloads the documents and folders.
+	ScopeDocumentsRead = "documents:read"
+	// ScopeDocumentsWrite uploads, modifies, moves and deletes the documents.
+	ScopeDocumentsWrite = "documents:write"
+	// ScopeFoldersManage creates, renames, moves and deletes the folders.
+	ScopeFoldersManage = "folders:manage"
+	// ScopeShare creates and manages the shares of documents and folders.
+	ScopeShare = "share"
+)
+
+var (
+	// CapabilityScopes are the scopes granting access to Digiposte.
+	CapabilityScopes = []string{ //nolint:gochecknoglobals
+		ScopeDocumentsRead, ScopeDocumentsWrite, ScopeFoldersManage, ScopeShare,
+	}
+	// SupportedScopes are the scopes known by the server. The OpenIDScopes are only granted if Config.OpenID is set.
+	SupportedScopes = append(append([]string(nil), CapabilityScopes...), OpenIDScopes...) //nolint:gochecknoglobals
+)
+
+var errUnknownScope = errors.New("unknown scope")
+
+// grantedScope returns the scope granted to the client for the requested one, among those supported by the server.
+// The scopes the client is not allowed are dropped, and all its capability scopes are granted if none is requested.
+// It fails with ErrInvalidScope if a requested scope is not supported, or if none of them is allowed.
+func (c *Client) grantedScope(requested string, supported []string) (string, error) {
+	allowed := c.AllowedScopes()
+
+	if strings.TrimSpace(requested) == "" {
+		// The identity of the user is only shared when asked for.
+		granted := make([]string, 0, len(allowed))
+
+		for _, scope := range allowed {
+			if stringsContain(CapabilityScopes, scope) {
+				granted = append(granted, scope)
+			}
+		}
+
+		return strings.Join(granted, " "), nil
+	}
+
+	granted := make([]string, 0, len(allowed))
+
+	for _, scope := range strings.Fields(requested) {
+		if !stringsContain(supported, scope) {
+			return "", oautherrs.ErrInvalidScope
+		}
+
+		if stringsContain(allowed, scope) && !stringsContain(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+
+	if len(granted) == 0 {
+		return "", oautherrs.ErrInvalidScope
+	}
+
+	return strings.Join(granted, " "), nil
+}
+
+// AllowedScopes returns the scopes the client may be granted. Unless restricted, it is all the supported ones.
+func (c *Client) AllowedScopes() []string {
+	if len(c.Scopes) > 0 {
+		return c.Scopes
+	}
+
+	return SupportedScopes
+}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !stringsContain(SupportedScopes, scope) {
+			return fmt.Errorf("%w: %q", errUnknownScope, scope)
+		}
+	}
+
+	return nil
+}
+
+// serverScopes returns the scopes supported by the configuration.
+func serverScopes(openID bool) []string {
+	if openID {
+		return SupportedScopes
+	}
+
+	return CapabilityScopes
+}
+
+// HasScope reports whether the scope of a token grants the required scope.
+// Tokens without scope grant none.
+func HasScope(granted, required string) bool {
+	return stringsContain(strings.Fields(granted), required)
+}
+
+// RequiredScope returns the scope a request forwarded to Digiposte requires.
+// The target is the configuration key of the Digiposte URL, and the path is relative to it.
+func RequiredScope(targetKey, method, path string) string {
+	safe := method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+
+	// The document server only serves and receives the content of the documents.
+	if targetKey == digiconfig.DocumentURLKey {
+		if safe {
+			return ScopeDocumentsRead
+		}
+
+		return ScopeDocumentsWrite
+	}
+
+	route := strings.Trim(path, "/")
+
+	// The routes of the API are versioned, such as /v3/folder.
+	if version, rest, ok := strings.Cut(route, "/"); ok && isAPIVersion(version) {
+		route = rest
+	}
+
+	resource, _, _ := strings.Cut(route, "/")
+
+	switch {
+	case resource == "share" || resource == "shares" || route == "partner/user/shares":
+		return ScopeShare
+	case safe || (method == http.MethodPost && route == "documents/search"):
+		return ScopeDocumentsRead
+	case resource == "folder" || resource == "folders":
+		return ScopeFoldersManage
+	}
+
+	return ScopeDocumentsWrite
+}
+
+// isAPIVersion reports whether the path segment is the version of the Digiposte API, such as v3.
+func isAPIVersion(segment string) bool {
+	return len(segment) > 1 && segment[0] == 'v' && strings.Trim(segment[1:], "0123456789") == ""
+}
+
+// authorizeScope replaces the requested scope with the one granted to the client,
+// so that the consent page shows what is actually granted.
+func authorizeScope(r *http.Request, manager oauth2.Manager, supported []string) error {
+	info, err := manager.GetClient(r.Context(), r.Form.Get("client_id"))
+	if err != nil {
+		return err //nolint:wrapcheck // oauth errors are matched by identity to build the response.
+	}
+
+	scope, err := toClient(info).grantedScope(r.Form.Get("scope"), supported)
+	if err != nil {
+		return err
+	}
+
+	r.Form.Set("scope", scope)
+
+	return nil
+}
+
+// clientScope replaces the scope requested with the grants which skip the authorize endpoint,
+// such as client_credentials, with the one granted to the client.
+func clientScope(manager oauth2.Manager, supported []string) func(*oauth2.TokenGenerateRequest) (bool, error) {
+	return func(tgr *oauth2.TokenGenerateRequest) (bool, error) {
+		info, err := manager.GetClient(tgr.Request.Context(), tgr.ClientID)
+		if err != nil {
+			return false, err //nolint:wrapcheck // oauth errors are matched by identity to build the response.
+		}
+
+		scope, err := toClient(info).grantedScope(tgr.Scope, supported)
+		if errors.Is(err, oautherrs.ErrInvalidScope) {
+			return false, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		tgr.Scope = scope
+
+		return true, nil
+	}
+}
+
+// refreshingScope only allows the scope of a refreshed token to be narrowed.
+func refreshingScope(tgr *oauth2.TokenGenerateRequest, oldScope string) (bool, error) {
+	for _, scope := range strings.Fields(tgr.Scope) {
+		if !HasScope(oldScope, scope) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -2,20 +2,19 @@ package digipoauth
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/go-oauth2/oauth2/v4"
 	oautherrs "github.com/go-oauth2/oauth2/v4/errors"
 	"github.com/go-oauth2/oauth2/v4/manage"
-	"github.com/go-oauth2/oauth2/v4/models"
 	"github.com/go-oauth2/oauth2/v4/server"
-	"github.com/go-oauth2/oauth2/v4/store"
 	digiconfig "github.com/holyhope/digiposte-oauth/config"
 )
 
@@ -32,83 +31,247 @@ const (
 )
 
 // Server is a local web server for collecting auth.
+// It serves the Handler, owning the listeners, TLS and the lifecycle.
 type Server struct {
-	server          *http.Server
-	listener        net.Listener
-	manager         *manage.Manager
-	clientStore     *store.ClientStore
-	accessGenerator *AccessGenerator
+	*Handler
+
+	server    *http.Server
+	listeners []net.Listener
+	tls       bool
 }
 
 type Config struct {
-	Addr        string
+	// Addr is the TCP address to listen on, if Listeners is empty.
+	Addr string
+	// Listeners are the addresses to serve on. The same endpoints are served on all of them.
+	Listeners []*ListenerConfig
+
 	Server      *server.Config
 	LoginMethod LoginMethod
-	Logger      *log.Logger
+	// Logger reports the errors that cannot be returned. Defaults to the standard logger.
+	Logger *log.Logger
+
+	// PathPrefix is the path under which the endpoints are served, such as "/oauth".
+	PathPrefix string
+	// Issuer is the base URL of the endpoints as reached by the clients, such as "https://example.com/oauth".
+	// It identifies the server in the metadata and the signed tokens, instead of the Host header of the requests.
+	// NewServer defaults it to the URL of its first TCP listener, while NewHandler requires it.
+	Issuer string
+
+	// TokenStore stores the issued tokens. Defaults to an in-memory store.
+	TokenStore oauth2.TokenStore
+	// ClientStore stores the registered clients. Defaults to an in-memory store.
+	// The clients missing from the store when registered reject the tokens issued earlier,
+	// so the tokens of a persistent TokenStore only survive the restarts along with a persistent ClientStore.
+	ClientStore ClientStore
+	// SecretHashCost is the bcrypt cost of the client secrets, which are stored hashed. Defaults to bcrypt.DefaultCost.
+	SecretHashCost int
+
+	// Getter reads the Digiposte configuration, such as the API URL. Defaults are used if nil.
+	Getter digiconfig.Getter
+	// RevokeDigiposteSession also logs the Digiposte session out when a token is revoked.
+	RevokeDigiposteSession bool
+	// IntrospectionClients are the resource servers allowed to introspect the tokens of all the clients.
+	// The other clients may only introspect their own tokens.
+	IntrospectionClients []string
+
+	// Device enables the device authorization grant when not nil.
+	// It requires Consent, whose passphrase protects the device verification page.
+	Device *DeviceConfig
+	// Proxy forwards the requests under APIProxyPath and DocumentProxyPath to Digiposte,
+	// authenticated with the session of the client owning the bearer token.
+	Proxy bool
+
+	// ClientsFile declares clients in a file, applied at startup and on change.
+	// The clients it declares are managed by the file: their secret and credentials cannot be changed by the admin API.
+	ClientsFile *ClientsFileConfig
+
+	// Audit records the authorizations, the token requests and the Digiposte logins when not nil.
+	Audit *AuditConfig
+
+	// Consent asks a human to approve the authorization requests when not nil.
+	Consent *ConsentConfig
+
+	// Admin enables the admin API managing the registered clients when not nil.
+	Admin *AdminConfig
+
+	// TLS serves HTTPS when not nil.
+	TLS *TLSConfig
+
+	// Refresher enables the background login before the Digiposte tokens expire when not nil.
+	Refresher *RefresherConfig
+	// TokenCache reuses the last Digiposte token of each account for the next code exchanges when not nil.
+	// It requires JWT, so that each grant keeps its own access token.
+	TokenCache *TokenCacheConfig
+	// JWT issues signed JWT access tokens when not nil, published at JWKSPath.
+	// The Digiposte tokens then stay on the server, used by the proxy on behalf of the clients.
+	JWT *JWTConfig
+	// OpenID enables the OpenID Connect layer: the openid scope, the ID tokens and UserInfoPath.
+	// It requires JWT, whose keys sign the ID tokens.
+	OpenID bool
+
+	// TokenExpiryMargin is subtracted from the Digiposte token expiry to get the one of the issued tokens,
+	// so that clients refresh before the Digiposte token dies. Defaults to DefaultTokenExpiryMargin.
+	TokenExpiryMargin time.Duration
 }
 
 // StartServer starts a local webserver to receive the auth.
 func NewServer(setter digiconfig.Setter, config *Config) (*Server, error) {
-	// client memory store
-	clientStore := store.NewClientStore()
+	listenerConfigs := config.Listeners
+	if len(listenerConfigs) == 0 {
+		listenerConfigs = []*ListenerConfig{{
+			Network:  TCPNetwork,
+			Addr:     config.Addr,
+			Mode:     0,
+			Listener: nil,
+		}}
+	}
 
-	accessGenerator := &AccessGenerator{
-		setter:      setter,
-		loginMethod: config.LoginMethod,
-		credentials: &sync.Map{},
+	tlsConfig, err := newTLSConfig(config.TLS, tcpAddrs(listenerConfigs))
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
 	}
 
-	manager := newManager(clientStore, accessGenerator)
+	listeners, err := listenAll(listenerConfigs)
+	if err != nil {
+		return nil, err
+	}
 
-	listener, err := net.Listen("tcp", config.Addr)
+	// The clients reach the endpoints through the listeners, whatever the Host header of their requests.
+	baseURLs := listenerBaseURLs(listeners, tlsConfig != nil, strings.TrimSuffix(config.PathPrefix, "/"))
+
+	handlerConfig := *config
+	if handlerConfig.Issuer == "" {
+		handlerConfig.Issuer = baseURLs[0]
+	}
+
+	handler, err := newHandler(setter, &handlerConfig, baseURLs)
 	if err != nil {
-		return nil, fmt.Errorf("listen: %w", err)
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+
+		return nil, err
 	}
 
 	return &Server{
-		server:          newServer(manager, config.Server, listener, config.Logger),
-		listener:        listener,
-		manager:         manager,
-		clientStore:     clientStore,
-		accessGenerator: accessGenerator,
+		Handler:   handler,
+		server:    newServer(handler, tlsConfig, config.Logger),
+		listeners: listeners,
+		tls:       tlsConfig != nil,
 	}, nil
 }
 
-// RegisterUser adds a user to the server.
-func (s *Server) RegisterUser(clientID, clientSecret, redirectURL, username, password, otpSecret string) error {
-	if err := s.clientStore.Set(clientID, &models.Client{
-		ID:     clientID,
-		Secret: clientSecret,
-		UserID: clientID,
-		Public: false,
-		Domain: redirectURL,
-	}); err != nil {
-		return fmt.Errorf("set client: %w", err)
-	}
-
-	s.accessGenerator.SetCredentials(clientID, &Credentials{
-		Username:  username,
-		Password:  password,
-		OTPSecret: otpSecret,
-	})
+// endpoints holds the dependencies of the HTTP endpoints.
+type endpoints struct {
+	oauthServer     *server.Server
+	manager         *manage.Manager
+	tokenStore      oauth2.TokenStore
+	accessGenerator *AccessGenerator
+	logger          *log.Logger
+	clientStore     ClientStore
+	secretHashCost  int
+	deviceGrants    *deviceGrants
+	assertions      *assertionVerifier
+	keys            *keySet
+	openID          *openIDProvider
+	auditLog        *auditLog
+	consent         *consentPage
+	scopes          []string
+
+	introspectionClients   []string
+	revokeDigiposteSession bool
+	proxy                  bool
+	pathPrefix             string
+	// issuers are the configured base URLs of the endpoints, never taken from the requests.
+	// The first one is the issuer, the others are other URLs of the listeners.
+	issuers []string
+}
 
-	return nil
+// issuer returns the configured base URL of the endpoints.
+func (e *endpoints) issuer() string {
+	return e.issuers[0]
 }
 
-func newServer(manager oauth2.Manager, config *server.Config, listener net.Listener, logger *log.Logger) *http.Server {
+func newMux(e *endpoints) (*http.ServeMux, error) {
 	mux := http.NewServeMux()
-	oauthServer := server.NewServer(config, manager)
 
-	mux.HandleFunc(AuthorizePath, func(w http.ResponseWriter, r *http.Request) {
-		if err := oauthServer.HandleAuthorizeRequest(w, r); err != nil {
-			logger.Printf("Failed to handle authorize request: %v", err)
+	mux.HandleFunc(AuthorizePath, e.audit(AuditActionAuthorize, func(w http.ResponseWriter, r *http.Request) {
+		// Errors about the client or the redirect URI must not be redirected to an unverified URI.
+		if err := e.checkRedirectURI(r); err != nil {
+			writeJSON(w, http.StatusBadRequest, err)
+
+			return
 		}
-	})
-	mux.HandleFunc(TokenPath, func(w http.ResponseWriter, r *http.Request) {
-		if err := oauthServer.HandleTokenRequest(w, r); err != nil {
-			logger.Printf("Failed to handle token request: %v", err)
+
+		if err := e.oauthServer.HandleAuthorizeRequest(w, r); err != nil {
+			e.logger.Printf("Failed to handle authorize request: %v", err)
+		}
+	}))
+	mux.HandleFunc(TokenPath, e.audit(AuditActionToken, func(w http.ResponseWriter, r *http.Request) {
+		client, err := e.authenticateClient(r)
+		if err != nil {
+			e.writeError(w, err)
+
+			return
+		}
+
+		if e.deviceGrants != nil && r.FormValue("grant_type") == DeviceCodeGrantType {
+			e.handleDeviceToken(w, r, client)
+
+			return
 		}
-	})
+
+		// The refresh tokens can only be used by the client they were issued to, until they are revoked.
+		if r.FormValue("grant_type") == oauth2.Refreshing.String() {
+			if info, err := e.manager.LoadRefreshToken(r.Context(), r.FormValue("refresh_token")); err == nil &&
+				(info.GetClientID() != client.ID || client.revoked(info.GetRefreshCreateAt())) {
+				e.writeError(w, oautherrs.ErrInvalidGrant)
+
+				return
+			}
+		}
+
+		r = r.WithContext(withAuthenticatedClient(r.Context(), client))
+
+		if err := e.oauthServer.HandleTokenRequest(w, r); err != nil {
+			e.logger.Printf("Failed to handle token request: %v", err)
+		}
+	}))
+	mux.HandleFunc(RevocationPath, e.audit(AuditActionRevocation, e.handleRevocation))
+	mux.HandleFunc(IntrospectionPath, e.handleIntrospection)
+	mux.HandleFunc(MetadataPath, e.handleMetadata)
+	mux.HandleFunc(OpenIDConfigurationPath, e.handleMetadata)
+
+	if e.keys != nil {
+		mux.HandleFunc(JWKSPath, e.handleJWKS)
+	}
+
+	if e.openID != nil {
+		mux.HandleFunc(UserInfoPath, e.handleUserInfo)
+	}
+
+	if e.deviceGrants != nil {
+		mux.HandleFunc(DeviceAuthorizationPath, e.audit(AuditActionDeviceAuthorization, e.handleDeviceAuthorization))
+		mux.HandleFunc(DeviceVerificationPath, e.audit(AuditActionDeviceVerification, e.handleDeviceVerification))
+	}
+
+	if e.proxy {
+		if err := e.handleProxies(mux); err != nil {
+			return nil, err
+		}
+	}
+
+	return mux, nil
+}
+
+func newOAuthServer(
+	manager oauth2.Manager,
+	config *server.Config,
+	consent *consentPage,
+	scopes []string,
+) *server.Server {
+	oauthServer := server.NewServer(config, manager)
 
 	oauthServer.SetAllowGetAccessRequest(true)
 
@@ -117,27 +280,67 @@ func newServer(manager oauth2.Manager, config *server.Config, listener net.Liste
 			return "", oautherrs.ErrInvalidRequest
 		}
 
-		return r.Form.Get("client_id"), nil
+		if err := checkPKCEPolicy(r, manager); err != nil {
+			return "", err
+		}
+
+		if err := authorizeScope(r, manager, scopes); err != nil {
+			return "", err
+		}
+
+		if consent == nil {
+			return r.Form.Get("client_id"), nil
+		}
+
+		// Unknown clients are rejected before asking for a consent.
+		if _, err := manager.GetClient(r.Context(), r.Form.Get("client_id")); err != nil {
+			return "", err //nolint:wrapcheck // oauth errors are matched by identity to build the response.
+		}
+
+		return consent.authorize(w, r)
 	}
 
-	oauthServer.ClientInfoHandler = func(r *http.Request) (string, string, error) {
-		if err := r.ParseForm(); err != nil {
-			return "", "", oautherrs.ErrInvalidRequest
+	oauthServer.InternalErrorHandler = func(err error) *oautherrs.Response {
+		// The manager reports a missing code_verifier as an internal error.
+		if errors.Is(err, oautherrs.ErrMissingCodeVerifier) {
+			return &oautherrs.Response{
+				Error:       oautherrs.ErrInvalidGrant,
+				ErrorCode:   0,
+				Description: "PKCE is required. code_verifier is missing or unexpected",
+				URI:         "",
+				StatusCode:  http.StatusBadRequest,
+				Header:      nil,
+			}
 		}
 
-		return r.Form.Get("client_id"), r.Form.Get("client_secret"), nil
+		return nil
 	}
 
+	// The scope is filtered for the client by the UserAuthorizationHandler, before asking for a consent.
+	oauthServer.AuthorizeScopeHandler = func(w http.ResponseWriter, r *http.Request) (string, error) {
+		return r.Form.Get("scope"), nil
+	}
+	oauthServer.RefreshingScopeHandler = refreshingScope
+	// The other grants, such as client_credentials, are filtered like the authorization requests.
+	oauthServer.ClientScopeHandler = clientScope(manager, scopes)
+
+	// The clients are authenticated before reaching the oauth server, with any of their AuthMethods.
+	oauthServer.ClientInfoHandler = clientInfoHandler
+
+	return oauthServer
+}
+
+func newServer(handler http.Handler, tlsConfig *tls.Config, logger *log.Logger) *http.Server {
 	httpServer := &http.Server{
-		Addr:              listener.Addr().String(),
+		Addr:              "",
 		ErrorLog:          logger,
-		Handler:           mux,
+		Handler:           handler,
 		ReadHeaderTimeout: ReadTimeout,
 		ReadTimeout:       ReadTimeout,
 		WriteTimeout:      WriteTimeout,
 		IdleTimeout:       WriteTimeout,
 
-		TLSConfig:      nil,
+		TLSConfig:      tlsConfig,
 		MaxHeaderBytes: 0,
 		BaseContext:    nil,
 		TLSNextProto:   nil,
@@ -148,12 +351,77 @@ func newServer(manager oauth2.Manager, config *server.Config, listener net.Liste
 	return httpServer
 }
 
-func newManager(cs oauth2.ClientStore, ag oauth2.AccessGenerate) *manage.Manager {
+// checkRedirectURI checks that the client exists and that the redirect URI is registered for it.
+// The redirect URI may be omitted if the client has only one.
+func (e *endpoints) checkRedirectURI(r *http.Request) *RedirectURIError {
+	clientID := r.FormValue("client_id")
+
+	info, err := e.manager.GetClient(r.Context(), clientID)
+	if err != nil || info == nil {
+		return &RedirectURIError{
+			Code:        oautherrs.ErrInvalidClient.Error(),
+			Description: fmt.Sprintf("unknown client %q", clientID),
+		}
+	}
+
+	client := toClient(info)
+	redirectURI := r.FormValue("redirect_uri")
+
+	switch {
+	case redirectURI == "" && len(client.redirectURIs()) > 1:
+		return &RedirectURIError{
+			Code:        oautherrs.ErrInvalidRequest.Error(),
+			Description: "redirect_uri is required: several redirect URIs are registered for the client",
+		}
+
+	case redirectURI != "" && !client.AllowsRedirectURI(redirectURI):
+		return &RedirectURIError{
+			Code:        oautherrs.ErrInvalidRequest.Error(),
+			Description: fmt.Sprintf("redirect_uri %q is not registered for the client", redirectURI),
+		}
+	}
+
+	return nil
+}
+
+// RedirectURIError is the OAuth error returned, instead of being redirected, when the redirect URI cannot be trusted.
+type RedirectURIError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *RedirectURIError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// checkPKCEPolicy rejects authorization requests without code_challenge for clients requiring PKCE.
+func checkPKCEPolicy(r *http.Request, manager oauth2.Manager) error {
+	if r.Form.Get("code_challenge") != "" {
+		return nil
+	}
+
+	info, err := manager.GetClient(r.Context(), r.Form.Get("client_id"))
+	if err != nil {
+		return err //nolint:wrapcheck // oauth errors are matched by identity to build the response.
+	}
+
+	if toClient(info).RequiresPKCE() {
+		return oautherrs.ErrCodeChallengeRquired
+	}
+
+	return nil
+}
+
+func newManager(cs oauth2.ClientStore, ts oauth2.TokenStore, ag oauth2.AccessGenerate) *manage.Manager {
 	manager := manage.NewDefaultManager()
 
-	manager.MustTokenStorage(store.NewMemoryTokenStore())
+	manager.MapTokenStorage(ts)
 	manager.MapClientStorage(cs)
 	manager.MapAccessGenerate(ag)
+	// The redirect URIs are checked against all those of the client before reaching the manager,
+	// which only knows about the domain of the client.
+	manager.SetValidateURIHandler(func(string, string) error { return nil })
+	// AccessTokenExp is only used when the expiry of the Digiposte token is unknown.
 	manager.SetRefreshTokenCfg(&manage.RefreshingConfig{
 		AccessTokenExp:     time.Hour,
 		IsGenerateRefresh:  true,
@@ -168,13 +436,46 @@ func newManager(cs oauth2.ClientStore, ag oauth2.AccessGenerate) *manage.Manager
 
 // Close closes the server.
 func (s *Server) Shutdown(ctx context.Context) error {
+	s.Handler.Close()
+
 	return s.server.Shutdown(ctx) //nolint:wrapcheck
 }
 
-// Start starts the server.
+// Start starts the server on all the listeners.
+// If one of them fails, the server is closed.
 func (s *Server) Start() error {
-	if err := s.server.Serve(s.listener); !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("serve: %w", err)
+	errs := make(chan error, len(s.listeners))
+
+	for _, listener := range s.listeners {
+		go func(listener net.Listener) {
+			errs <- s.serve(listener)
+		}(listener)
+	}
+
+	var firstErr error
+
+	for range s.listeners {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+
+			_ = s.server.Close()
+		}
+	}
+
+	return firstErr
+}
+
+func (s *Server) serve(listener net.Listener) error {
+	serve := s.server.Serve
+	if s.tls {
+		serve = func(listener net.Listener) error {
+			// The certificates are already in the TLS configuration.
+			return s.server.ServeTLS(listener, "", "")
+		}
+	}
+
+	if err := serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve %s: %w", listener.Addr(), err)
 	}
 
 	return nil
@@ -182,10 +483,50 @@ func (s *Server) Start() error {
 
 // AuthorizeURL returns the URL to the authorize endpoint.
 func (s *Server) AuthorizeURL() string {
-	return "http://" + s.listener.Addr().String() + AuthorizePath
+	return s.defaultURLs().AuthorizeURL()
 }
 
 // TokenURL returns the URL to the token endpoint.
 func (s *Server) TokenURL() string {
-	return "http://" + s.listener.Addr().String() + TokenPath
+	return s.defaultURLs().TokenURL()
+}
+
+// MetadataURL returns the URL to the authorization server metadata.
+func (s *Server) MetadataURL() string {
+	return s.defaultURLs().MetadataURL()
+}
+
+// RevocationURL returns the URL to the token revocation endpoint.
+func (s *Server) RevocationURL() string {
+	return s.defaultURLs().RevocationURL()
+}
+
+// IntrospectionURL returns the URL to the token introspection endpoint.
+func (s *Server) IntrospectionURL() string {
+	return s.defaultURLs().IntrospectionURL()
+}
+
+// APIProxyURL returns the URL of the proxy to the Digiposte API.
+func (s *Server) APIProxyURL() string {
+	return s.defaultURLs().APIProxyURL()
+}
+
+// DocumentProxyURL returns the URL of the proxy to the Digiposte document server.
+func (s *Server) DocumentProxyURL() string {
+	return s.defaultURLs().DocumentProxyURL()
+}
+
+// DeviceAuthorizationURL returns the URL to the device authorization endpoint.
+func (s *Server) DeviceAuthorizationURL() string {
+	return s.defaultURLs().DeviceAuthorizationURL()
+}
+
+// JWKSURL returns the URL to the key set verifying the signed tokens.
+func (s *Server) JWKSURL() string {
+	return s.defaultURLs().JWKSURL()
+}
+
+// UserInfoURL returns the URL to the OpenID Connect userinfo endpoint.
+func (s *Server) UserInfoURL() string {
+	return s.defaultURLs().UserInfoURL()
 }
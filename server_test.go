@@ -1,12 +1,36 @@
 package digipoauth_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"html"
+	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-oauth2/oauth2/v4/manage"
 	"github.com/go-oauth2/oauth2/v4/server"
 	digipoauth "github.com/holyhope/digiposte-oauth"
 	digiconfig "github.com/holyhope/digiposte-oauth/config"
@@ -14,6 +38,7 @@ import (
 	. "github.com/onsi/ginkgo/v2" //nolint:revive
 	. "github.com/onsi/gomega"    //nolint:revive
 	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
 )
 
@@ -31,6 +56,8 @@ var _ = Describe("Server", func() {
 		oauthServer *digipoauth.Server
 		testServer  *ghttp.Server
 		cfg         *oauth2.Config
+
+		serverConfig *digipoauth.Config
 	)
 
 	BeforeEach(func() {
@@ -39,7 +66,7 @@ var _ = Describe("Server", func() {
 
 		setter = &configfakes.FakeSetter{
 			SetStub: func(key, value string) {
-				Expect(key).To(Equal(digiconfig.CookiesKey))
+				Expect(key).To(BeElementOf(digiconfig.CookiesKey, digiconfig.AccountCookiesKey(Username)))
 				Expect(value).ToNot(BeEmpty())
 			},
 		}
@@ -64,15 +91,18 @@ var _ = Describe("Server", func() {
 				}}, nil
 		}
 
-		localServer, err := digipoauth.NewServer(
-			setter,
-			&digipoauth.Config{
-				Addr:        ":0", // Random port
-				Server:      server.NewConfig(),
-				Logger:      log.New(GinkgoWriter, "", log.Lmsgprefix),
-				LoginMethod: digipoauth.LoginMethodFunc(loginMethod),
-			},
-		)
+		serverConfig = &digipoauth.Config{
+			Addr:        ":0", // Random port
+			Server:      server.NewConfig(),
+			Logger:      log.New(GinkgoWriter, "", log.Lmsgprefix),
+			LoginMethod: digipoauth.LoginMethodFunc(loginMethod),
+			// Keeps the tests fast.
+			SecretHashCost: bcrypt.MinCost,
+		}
+	})
+
+	JustBeforeEach(func() {
+		localServer, err := digipoauth.NewServer(setter, serverConfig)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(localServer).ToNot(BeNil())
 
@@ -107,6 +137,37 @@ var _ = Describe("Server", func() {
 		}
 	})
 
+	authorize := func(opts ...oauth2.AuthCodeOption) url.Values {
+		var query url.Values
+
+		testServer.AppendHandlers(func(writer http.ResponseWriter, req *http.Request) {
+			query = req.URL.Query()
+
+			writer.WriteHeader(http.StatusNoContent)
+		})
+
+		resp, err := http.Get(cfg.AuthCodeURL("tests", opts...)) //nolint:noctx
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+		return query
+	}
+
+	keySet := func() *digipoauth.JSONWebKeySet {
+		resp, err := http.Get(oauthServer.JWKSURL()) //nolint:noctx
+		Expect(err).ToNot(HaveOccurred())
+
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var keys digipoauth.JSONWebKeySet
+		Expect(json.NewDecoder(resp.Body).Decode(&keys)).To(Succeed())
+
+		return &keys
+	}
+
 	Context("When using a password", func() {
 		It("Should fail with a bad password", func() {
 			_, err := cfg.PasswordCredentialsToken(context.Background(), "username", "password")
@@ -155,7 +216,2784 @@ var _ = Describe("Server", func() {
 		Expect(token.Valid()).To(BeTrue())
 
 		Expect(setter.Invocations()).To(HaveKeyWithValue("Set", ConsistOf(
-			ConsistOf(Equal(digiconfig.CookiesKey), Not(BeEmpty())),
+			ConsistOf(Equal(digiconfig.AccountCookiesKey(Username)), Not(BeEmpty())),
 		)))
 	})
-})
+
+	Context("When using PKCE", func() {
+		const PublicClientID = "public-client-id"
+
+		JustBeforeEach(func() {
+			Expect(oauthServer.RegisterUser(
+				PublicClientID, "", testServer.URL(),
+				Username, Password, OTPSecret,
+				&digipoauth.WithPublicClient{},
+			)).To(Succeed())
+
+			cfg.ClientID = PublicClientID
+			cfg.ClientSecret = ""
+		})
+
+		It("Should reject public clients without code_challenge", func() {
+			query := authorize()
+			Expect(query.Get("code")).To(BeEmpty())
+			Expect(query.Get("error")).To(Equal("invalid_request"))
+		})
+
+		It("Should not allow to register a public client with a secret", func() {
+			Expect(oauthServer.RegisterUser(
+				PublicClientID, ClientSecret, testServer.URL(),
+				Username, Password, OTPSecret,
+				&digipoauth.WithPublicClient{},
+			)).ToNot(Succeed())
+		})
+
+		It("Should exchange the code with the S256 verifier", func(ctx SpecContext) {
+			verifier := oauth2.GenerateVerifier()
+
+			code := authorize(oauth2.S256ChallengeOption(verifier)).Get("code")
+			Expect(code).ToNot(BeEmpty())
+
+			token, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Valid()).To(BeTrue())
+		})
+
+		It("Should exchange the code with the plain verifier", func(ctx SpecContext) {
+			verifier := oauth2.GenerateVerifier()
+
+			code := authorize(
+				oauth2.SetAuthURLParam("code_challenge_method", "plain"),
+				oauth2.SetAuthURLParam("code_challenge", verifier),
+			).Get("code")
+			Expect(code).ToNot(BeEmpty())
+
+			token, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Valid()).To(BeTrue())
+		})
+
+		It("Should reject a wrong verifier", func(ctx SpecContext) {
+			code := authorize(oauth2.S256ChallengeOption(oauth2.GenerateVerifier())).Get("code")
+			Expect(code).ToNot(BeEmpty())
+
+			_, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(oauth2.GenerateVerifier()))
+			Expect(err).To(MatchError(ContainSubstring("invalid_grant")))
+		})
+
+		It("Should reject a missing verifier", func(ctx SpecContext) {
+			code := authorize(oauth2.S256ChallengeOption(oauth2.GenerateVerifier())).Get("code")
+			Expect(code).ToNot(BeEmpty())
+
+			_, err := cfg.Exchange(ctx, code)
+			Expect(err).To(MatchError(ContainSubstring("invalid_grant")))
+		})
+	})
+
+	Context("When discovering the server", func() {
+		It("Should describe the endpoints", func() {
+			resp, err := http.Get(oauthServer.MetadataURL()) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			var metadata digipoauth.AuthorizationServerMetadata
+			Expect(json.NewDecoder(resp.Body).Decode(&metadata)).To(Succeed())
+
+			Expect(metadata.AuthorizationEndpoint).To(Equal(oauthServer.AuthorizeURL()))
+			Expect(metadata.TokenEndpoint).To(Equal(oauthServer.TokenURL()))
+			Expect(metadata.ResponseTypesSupported).To(ConsistOf("code", "token"))
+			Expect(metadata.GrantTypesSupported).To(ContainElements("authorization_code", "refresh_token"))
+			Expect(metadata.GrantTypesSupported).ToNot(ContainElement("password"))
+			Expect(metadata.CodeChallengeMethodsSupported).To(ConsistOf("plain", "S256"))
+			Expect(metadata.RevocationEndpoint).To(Equal(oauthServer.RevocationURL()))
+			Expect(metadata.TokenEndpointAuthMethodsSupported).To(ConsistOf(
+				"client_secret_basic", "client_secret_post", "private_key_jwt", "none",
+			))
+			Expect(metadata.ScopesSupported).To(Equal(digipoauth.CapabilityScopes))
+			Expect(metadata.UserInfoEndpoint).To(BeEmpty())
+		})
+
+		It("Should not take the advertised URLs from the Host header", func(ctx SpecContext) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, oauthServer.MetadataURL(), nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Host = "example.com"
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			var metadata digipoauth.AuthorizationServerMetadata
+			Expect(json.NewDecoder(resp.Body).Decode(&metadata)).To(Succeed())
+
+			Expect(metadata.Issuer).To(Equal(strings.TrimSuffix(oauthServer.MetadataURL(), digipoauth.MetadataPath)))
+			Expect(metadata.TokenEndpoint).To(Equal(oauthServer.TokenURL()))
+		})
+	})
+
+	Context("When authenticating clients", func() {
+		const JWTClientID = "jwt-client-id"
+
+		var key *ecdsa.PrivateKey
+
+		BeforeEach(func() {
+			var err error
+
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		JustBeforeEach(func() {
+			der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(oauthServer.RegisterUser(
+				JWTClientID, "", testServer.URL(),
+				Username, Password, OTPSecret,
+				&digipoauth.WithPublicKeys{Keys: []string{
+					string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: nil, Bytes: der})),
+				}},
+			)).To(Succeed())
+		})
+
+		tokenRequest := func(form url.Values) (int, map[string]interface{}) {
+			resp, err := http.PostForm(oauthServer.TokenURL(), form) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			var body map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+
+			return resp.StatusCode, body
+		}
+
+		assertionExchange := func(assertion string) url.Values {
+			cfg.ClientID = JWTClientID
+
+			return url.Values{
+				"grant_type":            {"authorization_code"},
+				"code":                  {authorize().Get("code")},
+				"redirect_uri":          {testServer.URL()},
+				"client_assertion_type": {digipoauth.ClientAssertionType},
+				"client_assertion":      {assertion},
+			}
+		}
+
+		It("Should accept the secret in the Authorization header", func(ctx SpecContext) {
+			cfg.Endpoint.AuthStyle = oauth2.AuthStyleInHeader
+
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Valid()).To(BeTrue())
+		})
+
+		It("Should reject requests using several methods", func(ctx SpecContext) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, oauthServer.TokenURL(), strings.NewReader(url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {authorize().Get("code")},
+				"redirect_uri":  {testServer.URL()},
+				"client_secret": {ClientSecret},
+			}.Encode()))
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(ClientID, ClientSecret)
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
+		It("Should accept a client assertion signed by a registered key", func() {
+			status, body := tokenRequest(assertionExchange(signAssertion(key, JWTClientID, oauthServer.TokenURL())))
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(HaveKeyWithValue("access_token", Not(BeEmpty())))
+		})
+
+		It("Should reject replayed assertions", func() {
+			assertion := signAssertion(key, JWTClientID, oauthServer.TokenURL())
+
+			status, _ := tokenRequest(assertionExchange(assertion))
+			Expect(status).To(Equal(http.StatusOK))
+
+			status, body := tokenRequest(assertionExchange(assertion))
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			Expect(body).To(HaveKeyWithValue("error", "invalid_client"))
+		})
+
+		It("Should reject assertions signed by another key", func() {
+			otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+
+			status, body := tokenRequest(assertionExchange(signAssertion(otherKey, JWTClientID, oauthServer.TokenURL())))
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			Expect(body).To(HaveKeyWithValue("error", "invalid_client"))
+		})
+
+		It("Should reject assertions issued for another server", func() {
+			status, body := tokenRequest(assertionExchange(signAssertion(key, JWTClientID, "https://example.com/token")))
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			Expect(body).To(HaveKeyWithValue("error", "invalid_client"))
+		})
+
+		It("Should not take the audience from the Host header", func(ctx SpecContext) {
+			form := assertionExchange(signAssertion(key, JWTClientID, "http://example.com"+digipoauth.TokenPath))
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, oauthServer.TokenURL(),
+				strings.NewReader(form.Encode()))
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Host = "example.com"
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("Should only allow the methods of the client", func() {
+			form := assertionExchange("")
+			form.Del("client_assertion")
+			form.Del("client_assertion_type")
+			form.Set("client_id", JWTClientID)
+
+			status, body := tokenRequest(form)
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			Expect(body).To(HaveKeyWithValue("error", "invalid_client"))
+		})
+
+		It("Should not refresh the tokens of another client", func(ctx SpecContext) {
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			status, body := tokenRequest(url.Values{
+				"grant_type":            {"refresh_token"},
+				"refresh_token":         {token.RefreshToken},
+				"client_assertion_type": {digipoauth.ClientAssertionType},
+				"client_assertion":      {signAssertion(key, JWTClientID, oauthServer.TokenURL())},
+			})
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			Expect(body).To(HaveKeyWithValue("error", "invalid_grant"))
+		})
+	})
+
+	Context("When storing the client secrets", func() {
+		const LegacyClientID = "legacy-client-id"
+
+		var clientsPath string
+
+		BeforeEach(func() {
+			clientsPath = filepath.Join(GinkgoT().TempDir(), "clients.json")
+
+			clientStore, err := digipoauth.NewFileClientStore(clientsPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			// Written before the secrets were hashed.
+			Expect(clientStore.Set(LegacyClientID, &digipoauth.Client{
+				ID:           LegacyClientID,
+				Secret:       ClientSecret,
+				Domain:       testServer.URL(),
+				UserID:       LegacyClientID,
+				RedirectURIs: []string{testServer.URL()},
+			})).To(Succeed())
+
+			serverConfig.ClientStore = clientStore
+		})
+
+		storedClient := func(clientID string) *digipoauth.Client {
+			content, err := os.ReadFile(clientsPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			var clients map[string]*digipoauth.Client
+			Expect(json.Unmarshal(content, &clients)).To(Succeed())
+			Expect(clients).To(HaveKey(clientID))
+
+			return clients[clientID]
+		}
+
+		It("Should only store the hash of the secrets", func() {
+			client := storedClient(ClientID)
+			Expect(client.Secret).To(BeEmpty())
+			Expect(bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(ClientSecret))).To(Succeed())
+		})
+
+		It("Should hash the plaintext secrets once used", func(ctx SpecContext) {
+			Expect(oauthServer.UpdateCredentials(ctx, LegacyClientID, &digipoauth.Credentials{
+				Username:  Username,
+				Password:  Password,
+				OTPSecret: OTPSecret,
+			})).To(Succeed())
+
+			cfg.ClientID = LegacyClientID
+
+			_, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			client := storedClient(LegacyClientID)
+			Expect(client.Secret).To(BeEmpty())
+			Expect(bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(ClientSecret))).To(Succeed())
+
+			_, err = cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should reject the wrong secrets of plaintext entries", func(ctx SpecContext) {
+			cfg.ClientID = LegacyClientID
+			cfg.ClientSecret = "wrong-secret"
+
+			_, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).To(HaveOccurred())
+
+			Expect(storedClient(LegacyClientID).Secret).To(Equal(ClientSecret))
+		})
+	})
+
+	Context("When serving HTTPS", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir = GinkgoT().TempDir()
+
+			serverConfig.Addr = "127.0.0.1:0"
+			serverConfig.TLS = &digipoauth.TLSConfig{
+				CertFile: "",
+				KeyFile:  "",
+				Dir:      dir,
+				Hosts:    nil,
+			}
+		})
+
+		trustingClient := func() *http.Client {
+			caPEM, err := os.ReadFile(filepath.Join(dir, digipoauth.CACertificateFile))
+			Expect(err).ToNot(HaveOccurred())
+
+			pool := x509.NewCertPool()
+			Expect(pool.AppendCertsFromPEM(caPEM)).To(BeTrue())
+
+			return &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						RootCAs:    pool,
+						MinVersion: tls.VersionTLS12,
+					},
+				},
+			}
+		}
+
+		It("Should serve the endpoints with the generated certificate", func() {
+			Expect(oauthServer.MetadataURL()).To(HavePrefix("https://"))
+
+			resp, err := trustingClient().Get(oauthServer.MetadataURL()) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			var metadata digipoauth.AuthorizationServerMetadata
+			Expect(json.NewDecoder(resp.Body).Decode(&metadata)).To(Succeed())
+			Expect(metadata.TokenEndpoint).To(Equal(oauthServer.TokenURL()))
+		})
+
+		It("Should keep the CA across restarts", func() {
+			caPEM, err := os.ReadFile(filepath.Join(dir, digipoauth.CACertificateFile))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.Remove(filepath.Join(dir, digipoauth.CertificateFile))).To(Succeed())
+
+			restarted, err := digipoauth.NewServer(setter, serverConfig)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restarted.Shutdown(context.Background())).To(Succeed())
+
+			Expect(os.ReadFile(filepath.Join(dir, digipoauth.CACertificateFile))).To(Equal(caPEM))
+			Expect(filepath.Join(dir, digipoauth.CertificateFile)).To(BeAnExistingFile())
+		})
+	})
+
+	Context("When listening on several addresses", func() {
+		var (
+			socket   string
+			listener net.Listener
+		)
+
+		BeforeEach(func() {
+			socket = filepath.Join(GinkgoT().TempDir(), "digiposte.sock")
+
+			var err error
+
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+
+			serverConfig.Listeners = []*digipoauth.ListenerConfig{
+				{Network: digipoauth.TCPNetwork, Addr: "127.0.0.1:0", Mode: 0, Listener: nil},
+				{Network: digipoauth.UnixNetwork, Addr: socket, Mode: 0, Listener: nil},
+				{Network: "", Addr: "", Mode: 0, Listener: listener},
+			}
+		})
+
+		getMetadata := func(client *http.Client, metadataURL string) *digipoauth.AuthorizationServerMetadata {
+			resp, err := client.Get(metadataURL) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			var metadata digipoauth.AuthorizationServerMetadata
+			Expect(json.NewDecoder(resp.Body).Decode(&metadata)).To(Succeed())
+
+			return &metadata
+		}
+
+		unixClient := func() *http.Client {
+			return &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+					},
+				},
+			}
+		}
+
+		It("Should serve the endpoints on all the listeners", func() {
+			urls := oauthServer.URLs()
+			Expect(urls).To(HaveLen(3))
+
+			Expect(urls[0].TokenURL()).To(Equal(oauthServer.TokenURL()))
+			Expect(urls[2].Addr).To(Equal(listener.Addr().String()))
+			Expect(urls[1].Network).To(Equal(digipoauth.UnixNetwork))
+			Expect(urls[1].TokenURL()).To(HavePrefix("http+unix://"))
+
+			// The metadata always advertise the issuer, whatever the listener and the Host header.
+			Expect(getMetadata(http.DefaultClient, urls[0].MetadataURL()).TokenEndpoint).To(Equal(urls[0].TokenURL()))
+			Expect(getMetadata(http.DefaultClient, urls[2].MetadataURL()).TokenEndpoint).To(Equal(urls[0].TokenURL()))
+			Expect(getMetadata(unixClient(), "http://localhost"+digipoauth.MetadataPath).TokenEndpoint).
+				To(Equal(urls[0].TokenURL()))
+		})
+
+		It("Should restrict the socket to its owner", func() {
+			info, err := os.Stat(socket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(digipoauth.DefaultUnixSocketMode))
+
+			// The socket is created in a private directory, removed once the socket is in place.
+			Expect(os.ReadDir(filepath.Dir(socket))).To(HaveLen(1))
+		})
+
+		It("Should not take over a socket in use", func() {
+			_, err := digipoauth.NewServer(setter, serverConfig)
+			Expect(err).To(MatchError(ContainSubstring("in use")))
+
+			getMetadata(unixClient(), "http://localhost"+digipoauth.MetadataPath)
+		})
+
+		It("Should not replace a file by the socket", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "file")
+			Expect(os.WriteFile(path, []byte("content"), 0o600)).To(Succeed())
+
+			config := *serverConfig
+			config.Listeners = []*digipoauth.ListenerConfig{
+				{Network: digipoauth.UnixNetwork, Addr: path, Mode: 0, Listener: nil},
+			}
+
+			_, err := digipoauth.NewServer(setter, &config)
+			Expect(err).To(MatchError(ContainSubstring("not a socket")))
+			Expect(os.ReadFile(path)).To(Equal([]byte("content")))
+		})
+
+		It("Should replace a stale socket", func(ctx SpecContext) {
+			path := filepath.Join(GinkgoT().TempDir(), "stale.sock")
+
+			stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+			Expect(err).ToNot(HaveOccurred())
+
+			stale.SetUnlinkOnClose(false)
+			Expect(stale.Close()).To(Succeed())
+
+			config := *serverConfig
+			config.Listeners = []*digipoauth.ListenerConfig{
+				{Network: digipoauth.UnixNetwork, Addr: path, Mode: 0, Listener: nil},
+			}
+
+			restarted, err := digipoauth.NewServer(setter, &config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restarted.Shutdown(ctx)).To(Succeed())
+		})
+
+		It("Should remove the socket on shutdown", func(ctx SpecContext) {
+			// Waits for the server to serve on the socket.
+			getMetadata(unixClient(), "http://localhost"+digipoauth.MetadataPath)
+
+			Expect(oauthServer.Shutdown(ctx)).To(Succeed())
+
+			_, err := os.Stat(socket)
+			Expect(err).To(MatchError(os.ErrNotExist))
+		})
+	})
+
+	Context("When revoking a token", func() {
+		var token *oauth2.Token
+
+		revoke := func(value string) *http.Response {
+			resp, err := http.PostForm(oauthServer.RevocationURL(), url.Values{ //nolint:noctx
+				"client_id":     {ClientID},
+				"client_secret": {ClientSecret},
+				"token":         {value},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+
+			return resp
+		}
+
+		JustBeforeEach(func(ctx SpecContext) {
+			var err error
+
+			token, err = cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should not refresh a revoked token", func(ctx SpecContext) {
+			Expect(revoke(token.AccessToken).StatusCode).To(Equal(http.StatusOK))
+
+			token.Expiry = time.Now().Add(-time.Minute)
+
+			_, err := cfg.TokenSource(ctx, token).Token()
+			Expect(err).To(MatchError(ContainSubstring("invalid_grant")))
+		})
+
+		It("Should ignore unknown tokens", func() {
+			Expect(revoke("unknown").StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("Should authenticate the client", func() {
+			resp, err := http.PostForm(oauthServer.RevocationURL(), url.Values{ //nolint:noctx
+				"client_id":     {ClientID},
+				"client_secret": {"wrong-secret"},
+				"token":         {token.AccessToken},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		Context("With the Digiposte session", func() {
+			BeforeEach(func() {
+				serverConfig.RevokeDigiposteSession = true
+				serverConfig.Getter = digiconfig.GetterFunc(func(key string) (string, bool) {
+					switch key {
+					case digiconfig.APIURLKey:
+						return testServer.URL(), true
+					case digiconfig.UsernameKey:
+						return Username, true
+					default:
+						return "", false
+					}
+				})
+			})
+
+			// clearedKeys returns the keys of the cookies cleared by the last revocation.
+			clearedKeys := func() []string {
+				keys := []string{}
+
+				for i := 0; i < setter.SetCallCount(); i++ {
+					if key, cookies := setter.SetArgsForCall(i); cookies == "[]" {
+						keys = append(keys, key)
+					}
+				}
+
+				return keys
+			}
+
+			It("Should log out and clear the cookies", func() {
+				testServer.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest(http.MethodPost, "/v3/profile/logout"),
+					ghttp.VerifyHeaderKV("Authorization", "Bearer access-token"),
+					ghttp.RespondWith(http.StatusNoContent, nil),
+				))
+
+				Expect(revoke(token.RefreshToken).StatusCode).To(Equal(http.StatusOK))
+
+				Expect(testServer.ReceivedRequests()).To(HaveLen(2))
+				// The cookies of the configured account are also cleared where they were kept before.
+				Expect(clearedKeys()).To(ConsistOf(digiconfig.AccountCookiesKey(Username), digiconfig.CookiesKey))
+			})
+
+			Context("With another account", func() {
+				const (
+					OtherClientID = "other-client-id"
+					OtherUsername = "other-username"
+				)
+
+				BeforeEach(func() {
+					setter.SetStub = func(key, _ string) {
+						Expect(key).To(BeElementOf(
+							digiconfig.CookiesKey, digiconfig.AccountCookiesKey(Username), digiconfig.AccountCookiesKey(OtherUsername),
+						))
+					}
+
+					serverConfig.LoginMethod = digipoauth.LoginMethodFunc(
+						func(_ context.Context, creds *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+							return &oauth2.Token{
+								AccessToken:  "access-token-" + creds.Username,
+								TokenType:    "token-type",
+								RefreshToken: "refresh-token-" + creds.Username,
+								Expiry:       time.Now().Add(time.Hour),
+							}, []*http.Cookie{{
+								Name:  "cookie-name",
+								Value: "cookie-value",
+							}}, nil
+						},
+					)
+				})
+
+				JustBeforeEach(func(ctx SpecContext) {
+					Expect(oauthServer.RegisterUser(
+						OtherClientID, ClientSecret, testServer.URL(),
+						OtherUsername, Password, OTPSecret,
+					)).To(Succeed())
+
+					other := *cfg
+					other.ClientID = OtherClientID
+
+					_, err := other.Exchange(ctx, authorize(oauth2.SetAuthURLParam("client_id", OtherClientID)).Get("code"))
+					Expect(err).ToNot(HaveOccurred())
+				})
+
+				It("Should keep the cookies of the other account", func() {
+					testServer.AppendHandlers(ghttp.RespondWith(http.StatusNoContent, nil))
+
+					Expect(revoke(token.RefreshToken).StatusCode).To(Equal(http.StatusOK))
+
+					otherCookies := []string{}
+
+					for i := 0; i < setter.SetCallCount(); i++ {
+						if key, cookies := setter.SetArgsForCall(i); key == digiconfig.AccountCookiesKey(OtherUsername) {
+							otherCookies = append(otherCookies, cookies)
+						}
+					}
+
+					Expect(otherCookies).ToNot(BeEmpty())
+					Expect(otherCookies).ToNot(ContainElement("[]"))
+
+					Expect(clearedKeys()).To(ConsistOf(digiconfig.AccountCookiesKey(Username), digiconfig.CookiesKey))
+				})
+			})
+		})
+	})
+
+	Context("When introspecting a token", func() {
+		const ResourceServerID = "resource-server-id"
+
+		introspectAs := func(clientID, value string) *digipoauth.IntrospectionResponse {
+			resp, err := http.PostForm(oauthServer.IntrospectionURL(), url.Values{ //nolint:noctx
+				"client_id":     {clientID},
+				"client_secret": {ClientSecret},
+				"token":         {value},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			var response digipoauth.IntrospectionResponse
+			Expect(json.NewDecoder(resp.Body).Decode(&response)).To(Succeed())
+
+			return &response
+		}
+
+		introspect := func(value string) *digipoauth.IntrospectionResponse {
+			return introspectAs(ClientID, value)
+		}
+
+		JustBeforeEach(func() {
+			Expect(oauthServer.RegisterUser(
+				ResourceServerID, ClientSecret, testServer.URL(),
+				Username, Password, OTPSecret,
+			)).To(Succeed())
+		})
+
+		It("Should describe an active token", func(ctx SpecContext) {
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			response := introspect(token.AccessToken)
+			Expect(response.Active).To(BeTrue())
+			Expect(response.ClientID).To(Equal(ClientID))
+			Expect(response.Username).To(Equal(Username))
+			Expect(response.TokenType).To(Equal("Bearer"))
+			Expect(response.ExpiresAt).To(BeNumerically(">", time.Now().Unix()))
+
+			Expect(introspect(token.RefreshToken).Active).To(BeTrue())
+		})
+
+		It("Should report unknown tokens as inactive", func() {
+			Expect(introspect("unknown")).To(Equal(&digipoauth.IntrospectionResponse{}))
+		})
+
+		It("Should reject unauthenticated clients", func() {
+			resp, err := http.PostForm(oauthServer.IntrospectionURL(), url.Values{ //nolint:noctx
+				"client_id": {ClientID},
+				"token":     {"unknown"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("Should not describe the tokens of the other clients", func(ctx SpecContext) {
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(introspectAs(ResourceServerID, token.AccessToken)).To(Equal(&digipoauth.IntrospectionResponse{}))
+		})
+
+		Context("With an introspection client", func() {
+			BeforeEach(func() {
+				serverConfig.IntrospectionClients = []string{ResourceServerID}
+			})
+
+			It("Should describe the tokens of the other clients", func(ctx SpecContext) {
+				token, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+
+				response := introspectAs(ResourceServerID, token.AccessToken)
+				Expect(response.Active).To(BeTrue())
+				Expect(response.ClientID).To(Equal(ClientID))
+			})
+
+			It("Should report the tokens of a disabled client as inactive", func(ctx SpecContext) {
+				token, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(oauthServer.SetClientDisabled(ctx, ClientID, true)).To(Succeed())
+
+				Expect(introspectAs(ResourceServerID, token.AccessToken).Active).To(BeFalse())
+			})
+		})
+	})
+
+	Context("When refreshing a token", func() {
+		var (
+			logins     int
+			renewals   atomic.Int32
+			renewError error
+			renewing   chan struct{}
+			token      *oauth2.Token
+		)
+
+		BeforeEach(func() {
+			logins, renewError, renewing = 0, nil, nil
+			renewals.Store(0)
+
+			login := serverConfig.LoginMethod
+
+			serverConfig.LoginMethod = &renewingLoginMethod{
+				LoginMethod: digipoauth.LoginMethodFunc(
+					func(ctx context.Context, creds *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+						logins++
+
+						digiposteToken, cookies, err := login.Login(ctx, creds)
+						if err == nil {
+							// Each grant has its own refresh token.
+							digiposteToken.RefreshToken = fmt.Sprintf("refresh-token-%d", logins)
+						}
+
+						return digiposteToken, cookies, err
+					},
+				),
+				renew: func(_ context.Context, _ *digipoauth.Credentials, cookies []*http.Cookie) (*oauth2.Token, []*http.Cookie, error) {
+					renewals.Add(1)
+
+					if renewing != nil {
+						<-renewing
+					}
+
+					Expect(cookies).To(HaveLen(1))
+					Expect(cookies[0].Value).To(Equal("cookie-value"))
+
+					if renewError != nil {
+						return nil, nil, renewError
+					}
+
+					return &oauth2.Token{
+						AccessToken:  "renewed-access-token",
+						TokenType:    "token-type",
+						RefreshToken: "",
+						Expiry:       time.Now().Add(time.Hour),
+					}, nil, nil
+				},
+			}
+		})
+
+		JustBeforeEach(func(ctx SpecContext) {
+			var err error
+
+			token, err = cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			token.Expiry = time.Now().Add(-time.Minute)
+		})
+
+		It("Should renew the session from the cookies", func(ctx SpecContext) {
+			refreshed, err := cfg.TokenSource(ctx, token).Token()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(refreshed.AccessToken).To(Equal("renewed-access-token"))
+
+			Expect(logins).To(Equal(1))
+			Expect(renewals.Load()).To(BeEquivalentTo(1))
+		})
+
+		It("Should share a single renewal between concurrent refreshes", func(ctx SpecContext) {
+			other, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			other.Expiry = time.Now().Add(-time.Minute)
+			renewing = make(chan struct{})
+
+			var released sync.Once
+
+			release := func() { released.Do(func() { close(renewing) }) }
+			DeferCleanup(release)
+
+			errs := make(chan error, 2)
+
+			for _, refreshed := range []*oauth2.Token{token, other} {
+				go func(refreshed *oauth2.Token) {
+					_, err := cfg.TokenSource(ctx, refreshed).Token()
+					errs <- err
+				}(refreshed)
+			}
+
+			Eventually(renewals.Load).Should(BeEquivalentTo(1))
+			Consistently(renewals.Load).WithTimeout(300 * time.Millisecond).Should(BeEquivalentTo(1))
+
+			release()
+
+			Expect(<-errs).To(Succeed())
+			Expect(<-errs).To(Succeed())
+			Expect(renewals.Load()).To(BeEquivalentTo(1))
+		})
+
+		It("Should fall back to the login method", func(ctx SpecContext) {
+			renewError = errors.New("expired cookies")
+
+			refreshed, err := cfg.TokenSource(ctx, token).Token()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(refreshed.AccessToken).To(Equal("access-token"))
+
+			Expect(logins).To(Equal(2))
+			Expect(renewals.Load()).To(BeEquivalentTo(1))
+		})
+
+		Context("With the audit log", func() {
+			var (
+				mutex   sync.Mutex
+				renewed []*digipoauth.AuditEvent
+			)
+
+			BeforeEach(func() {
+				renewed = nil
+
+				serverConfig.Audit = &digipoauth.AuditConfig{
+					Path: "",
+					Sink: digipoauth.AuditSinkFunc(func(event *digipoauth.AuditEvent) error {
+						mutex.Lock()
+						defer mutex.Unlock()
+
+						if event.Action == digipoauth.AuditActionRenew {
+							renewed = append(renewed, event)
+						}
+
+						return nil
+					}),
+				}
+			})
+
+			recorded := func() []*digipoauth.AuditEvent {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				return append([]*digipoauth.AuditEvent(nil), renewed...)
+			}
+
+			It("Should record the renewals", func(ctx SpecContext) {
+				_, err := cfg.TokenSource(ctx, token).Token()
+				Expect(err).ToNot(HaveOccurred())
+
+				events := recorded()
+				Expect(events).To(HaveLen(1))
+				Expect(events[0].Outcome).To(Equal(digipoauth.AuditOutcomeSuccess))
+				Expect(events[0].Username).To(Equal(Username))
+			})
+
+			It("Should record the failed renewals", func(ctx SpecContext) {
+				renewError = errors.New("expired cookies")
+
+				_, err := cfg.TokenSource(ctx, token).Token()
+				Expect(err).ToNot(HaveOccurred())
+
+				events := recorded()
+				Expect(events).To(HaveLen(1))
+				Expect(events[0].Outcome).To(Equal(digipoauth.AuditOutcomeFailure))
+				Expect(events[0].Error).To(Equal("login_failed"))
+			})
+		})
+	})
+
+	Context("When refreshing tokens in the background", func() {
+		var logins atomic.Int32
+
+		BeforeEach(func() {
+			logins.Store(0)
+
+			login := serverConfig.LoginMethod
+
+			serverConfig.LoginMethod = digipoauth.LoginMethodFunc(
+				func(ctx context.Context, creds *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+					logins.Add(1)
+
+					return login.Login(ctx, creds)
+				},
+			)
+			serverConfig.Refresher = &digipoauth.RefresherConfig{
+				Before:              time.Hour - time.Second,
+				Jitter:              time.Millisecond,
+				MaxConcurrentLogins: 1,
+			}
+		})
+
+		It("Should serve the refresh from the warm result", func(ctx SpecContext) {
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logins.Load()).To(BeEquivalentTo(1))
+
+			Eventually(logins.Load).WithTimeout(5 * time.Second).Should(BeEquivalentTo(2))
+
+			token.Expiry = time.Now().Add(-time.Minute)
+
+			refreshed, err := cfg.TokenSource(ctx, token).Token()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(refreshed.AccessToken).To(Equal("access-token"))
+			Expect(logins.Load()).To(BeEquivalentTo(2))
+		})
+	})
+
+	Context("When signing the access tokens", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir = GinkgoT().TempDir()
+
+			serverConfig.JWT = &digipoauth.JWTConfig{Dir: dir}
+			serverConfig.Proxy = true
+			serverConfig.Getter = digiconfig.GetterFunc(func(key string) (string, bool) {
+				if key == digiconfig.APIURLKey {
+					return testServer.URL() + "/v3", true
+				}
+
+				return "", false
+			})
+		})
+
+		It("Should issue tokens verified by the published keys", func(ctx SpecContext) {
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.AccessToken).ToNot(Equal("access-token"))
+			Expect(token.RefreshToken).ToNot(Equal("refresh-token"))
+
+			var claims digipoauth.AccessTokenClaims
+			Expect(verifyJWT(keySet(), token.AccessToken, &claims)).To(Equal("at+jwt"))
+
+			Expect(claims.Issuer).To(Equal(strings.TrimSuffix(oauthServer.MetadataURL(), digipoauth.MetadataPath)))
+			Expect(claims.ClientID).To(Equal(ClientID))
+			Expect(claims.Subject).To(Equal(ClientID))
+			Expect(claims.ID).ToNot(BeEmpty())
+			Expect(time.Unix(claims.ExpiresAt, 0)).To(BeTemporally("~", token.Expiry, 2*time.Second))
+		})
+
+		It("Should publish the key set in the metadata", func() {
+			resp, err := http.Get(oauthServer.MetadataURL()) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			var metadata digipoauth.AuthorizationServerMetadata
+			Expect(json.NewDecoder(resp.Body).Decode(&metadata)).To(Succeed())
+			Expect(metadata.JWKSURI).To(Equal(oauthServer.JWKSURL()))
+		})
+
+		It("Should keep the Digiposte token on the server", func(ctx SpecContext) {
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			testServer.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest(http.MethodGet, "/v3/profile"),
+				ghttp.VerifyHeaderKV("Authorization", "Bearer access-token"),
+				ghttp.RespondWith(http.StatusOK, "{}"),
+			))
+
+			proxied := func() int {
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, oauthServer.APIProxyURL()+"profile", nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.Body.Close()).To(Succeed())
+
+				return resp.StatusCode
+			}
+
+			Expect(proxied()).To(Equal(http.StatusOK))
+
+			resp, err := http.PostForm(oauthServer.RevocationURL(), url.Values{ //nolint:noctx
+				"client_id":     {ClientID},
+				"client_secret": {ClientSecret},
+				"token":         {token.AccessToken},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+
+			Expect(proxied()).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("Should not take the issuer from the Host header", func(ctx SpecContext) {
+			code := authorize().Get("code")
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, oauthServer.TokenURL(), strings.NewReader(url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {code},
+				"redirect_uri":  {testServer.URL()},
+				"client_id":     {ClientID},
+				"client_secret": {ClientSecret},
+			}.Encode()))
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Host = "example.com"
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			var token oauth2.Token
+			Expect(json.NewDecoder(resp.Body).Decode(&token)).To(Succeed())
+
+			var claims digipoauth.AccessTokenClaims
+			Expect(verifyJWT(keySet(), token.AccessToken, &claims)).To(Equal("at+jwt"))
+			Expect(claims.Issuer).To(Equal(strings.TrimSuffix(oauthServer.MetadataURL(), digipoauth.MetadataPath)))
+			Expect(claims.Audience).To(Equal(claims.Issuer))
+		})
+
+		It("Should require the issuer of the handler", func() {
+			_, err := digipoauth.NewHandler(setter, &digipoauth.Config{
+				Server: server.NewConfig(),
+				JWT:    &digipoauth.JWTConfig{Dir: dir},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("With an issuer", func() {
+			BeforeEach(func() {
+				serverConfig.Issuer = "https://example.com/oauth"
+			})
+
+			It("Should issue the tokens for it", func(ctx SpecContext) {
+				token, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+
+				var claims digipoauth.AccessTokenClaims
+				Expect(verifyJWT(keySet(), token.AccessToken, &claims)).To(Equal("at+jwt"))
+				Expect(claims.Issuer).To(Equal("https://example.com/oauth"))
+				Expect(claims.Audience).To(Equal("https://example.com/oauth"))
+			})
+		})
+
+		It("Should keep the keys across restarts", func() {
+			handler, err := digipoauth.NewHandler(setter, &digipoauth.Config{
+				Server: server.NewConfig(),
+				Issuer: "https://example.com",
+				JWT:    &digipoauth.JWTConfig{Dir: dir},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			DeferCleanup(handler.Close)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, digipoauth.JWKSPath, nil))
+
+			var keys digipoauth.JSONWebKeySet
+			Expect(json.NewDecoder(recorder.Body).Decode(&keys)).To(Succeed())
+			Expect(keys).To(Equal(*keySet()))
+		})
+
+		Context("With a short rotation interval", func() {
+			BeforeEach(func() {
+				serverConfig.JWT.RotationInterval = 100 * time.Millisecond
+			})
+
+			It("Should sign with a new key and still publish the previous one", func(ctx SpecContext) {
+				first, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+
+				time.Sleep(200 * time.Millisecond)
+
+				second, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+
+				keys := keySet()
+				Expect(keys.Keys).To(HaveLen(2))
+
+				var claims digipoauth.AccessTokenClaims
+				Expect(verifyJWT(keys, first.AccessToken, &claims)).To(Equal("at+jwt"))
+				Expect(verifyJWT(keys, second.AccessToken, &claims)).To(Equal("at+jwt"))
+				Expect(jwtKeyID(first.AccessToken)).ToNot(Equal(jwtKeyID(second.AccessToken)))
+			})
+		})
+	})
+
+	Context("When issuing tokens", func() {
+		var expiry time.Time
+
+		BeforeEach(func() {
+			expiry = time.Now().Add(10 * time.Minute)
+
+			serverConfig.LoginMethod = digipoauth.LoginMethodFunc(
+				func(ctx context.Context, creds *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+					return &oauth2.Token{
+						AccessToken:  "access-token",
+						TokenType:    "token-type",
+						RefreshToken: "refresh-token",
+						Expiry:       expiry,
+					}, nil, nil
+				},
+			)
+			serverConfig.TokenExpiryMargin = 2 * time.Minute
+		})
+
+		It("Should expire before the Digiposte token", func(ctx SpecContext) {
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Expiry).To(BeTemporally("~", expiry.Add(-2*time.Minute), 5*time.Second))
+		})
+
+		It("Should also expire before the Digiposte token when refreshed", func(ctx SpecContext) {
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			expiry = time.Now().Add(20 * time.Minute)
+			token.Expiry = time.Now().Add(-time.Minute)
+
+			refreshed, err := cfg.TokenSource(ctx, token).Token()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(refreshed.Expiry).To(BeTemporally("~", expiry.Add(-2*time.Minute), 5*time.Second))
+		})
+
+		It("Should use the default lifetime if the Digiposte token expiry is unknown", func(ctx SpecContext) {
+			expiry = time.Time{}
+
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Expiry).To(BeTemporally("~",
+				time.Now().Add(manage.DefaultAuthorizeCodeTokenCfg.AccessTokenExp), 5*time.Second,
+			))
+		})
+	})
+
+	Context("When caching the Digiposte tokens", func() {
+		var (
+			logins   atomic.Int32
+			lifetime time.Duration
+		)
+
+		BeforeEach(func() {
+			logins.Store(0)
+
+			lifetime = time.Hour
+
+			serverConfig.LoginMethod = digipoauth.LoginMethodFunc(
+				func(ctx context.Context, creds *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+					login := logins.Add(1)
+
+					var expiry time.Time
+					if lifetime != 0 {
+						expiry = time.Now().Add(lifetime)
+					}
+
+					return &oauth2.Token{
+						AccessToken:  fmt.Sprintf("access-token-%d", login),
+						TokenType:    "token-type",
+						RefreshToken: "refresh-token",
+						Expiry:       expiry,
+					}, nil, nil
+				},
+			)
+			serverConfig.JWT = &digipoauth.JWTConfig{Dir: GinkgoT().TempDir()}
+			serverConfig.TokenCache = &digipoauth.TokenCacheConfig{
+				MinRemaining: time.Minute,
+			}
+		})
+
+		It("Should reuse the token of the account", func(ctx SpecContext) {
+			first, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			second, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(logins.Load()).To(BeEquivalentTo(1))
+			Expect(second.AccessToken).ToNot(Equal(first.AccessToken))
+			Expect(second.RefreshToken).ToNot(Equal(first.RefreshToken))
+		})
+
+		It("Should not reuse a token without expiry", func(ctx SpecContext) {
+			lifetime = 0
+
+			_, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(logins.Load()).To(BeEquivalentTo(2))
+		})
+
+		It("Should require the signing keys", func() {
+			_, err := digipoauth.NewHandler(setter, &digipoauth.Config{
+				Server:     server.NewConfig(),
+				Issuer:     "https://example.com",
+				TokenCache: &digipoauth.TokenCacheConfig{},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should log in again when the token expires soon", func(ctx SpecContext) {
+			lifetime = 30 * time.Second
+
+			_, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(logins.Load()).To(BeEquivalentTo(2))
+		})
+
+		It("Should not reuse a revoked token", func(ctx SpecContext) {
+			first, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := http.PostForm(oauthServer.RevocationURL(), url.Values{ //nolint:noctx
+				"client_id":     {ClientID},
+				"client_secret": {ClientSecret},
+				"token":         {first.AccessToken},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			second, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(logins.Load()).To(BeEquivalentTo(2))
+			Expect(second.AccessToken).ToNot(Equal(first.AccessToken))
+		})
+
+		Context("With the proxy", func() {
+			BeforeEach(func() {
+				serverConfig.Proxy = true
+				serverConfig.Getter = digiconfig.GetterFunc(func(key string) (string, bool) {
+					if key == digiconfig.APIURLKey {
+						return testServer.URL() + "/v3", true
+					}
+
+					return "", false
+				})
+			})
+
+			It("Should not reuse a token rejected by Digiposte", func(ctx SpecContext) {
+				first, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+
+				testServer.AppendHandlers(
+					ghttp.RespondWith(http.StatusUnauthorized, nil),
+					ghttp.CombineHandlers(
+						ghttp.VerifyHeaderKV("Authorization", "Bearer access-token-2"),
+						ghttp.RespondWith(http.StatusOK, "{}"),
+					),
+				)
+
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, oauthServer.APIProxyURL()+"profile", nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				req.Header.Set("Authorization", "Bearer "+first.AccessToken)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.Body.Close()).To(Succeed())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				second, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logins.Load()).To(BeEquivalentTo(2))
+				Expect(second.AccessToken).ToNot(Equal(first.AccessToken))
+			})
+		})
+	})
+
+	Context("When logging in concurrently", func() {
+		const OtherClientID = "other-client-id"
+
+		var (
+			logins    atomic.Int32
+			cancelled atomic.Bool
+			release   chan struct{}
+		)
+
+		BeforeEach(func() {
+			logins.Store(0)
+			cancelled.Store(false)
+
+			release = make(chan struct{})
+			login := serverConfig.LoginMethod
+
+			serverConfig.LoginMethod = digipoauth.LoginMethodFunc(
+				func(ctx context.Context, creds *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+					logins.Add(1)
+
+					select {
+					case <-release:
+					case <-ctx.Done():
+						cancelled.Store(true)
+
+						return nil, nil, ctx.Err()
+					}
+
+					return login.Login(ctx, creds)
+				},
+			)
+		})
+
+		JustBeforeEach(func() {
+			Expect(oauthServer.RegisterUser(
+				OtherClientID, ClientSecret, testServer.URL(),
+				Username, Password, OTPSecret,
+			)).To(Succeed())
+		})
+
+		// exchange exchanges a new code of the client in the background.
+		exchange := func(ctx context.Context, clientID string) <-chan error {
+			clientCfg := *cfg
+			clientCfg.ClientID = clientID
+
+			original := cfg
+			cfg = &clientCfg
+			code := authorize().Get("code")
+			cfg = original
+
+			errs := make(chan error, 1)
+
+			go func() {
+				_, err := clientCfg.Exchange(ctx, code)
+				errs <- err
+			}()
+
+			return errs
+		}
+
+		It("Should share a single login between the clients of the same account", func(ctx SpecContext) {
+			first := exchange(ctx, ClientID)
+			second := exchange(ctx, OtherClientID)
+
+			Consistently(logins.Load).WithTimeout(300 * time.Millisecond).Should(BeEquivalentTo(1))
+
+			close(release)
+
+			Expect(<-first).To(Succeed())
+			Expect(<-second).To(Succeed())
+			Expect(logins.Load()).To(BeEquivalentTo(1))
+		})
+
+		It("Should keep the login going for the remaining waiters", func(ctx SpecContext) {
+			shortCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+			defer cancel()
+
+			first := exchange(shortCtx, ClientID)
+			second := exchange(ctx, OtherClientID)
+
+			Expect(<-first).ToNot(Succeed())
+
+			close(release)
+
+			Expect(<-second).To(Succeed())
+			Expect(logins.Load()).To(BeEquivalentTo(1))
+			Expect(cancelled.Load()).To(BeFalse())
+		})
+
+		It("Should cancel the login once nobody waits for it", func(ctx SpecContext) {
+			shortCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+			defer cancel()
+
+			Expect(<-exchange(shortCtx, ClientID)).ToNot(Succeed())
+
+			Eventually(cancelled.Load).Should(BeTrue())
+		})
+	})
+
+	Context("When proxying the Digiposte API", func() {
+		var (
+			logins int
+			token  *oauth2.Token
+		)
+
+		BeforeEach(func() {
+			logins = 0
+
+			login := serverConfig.LoginMethod
+
+			serverConfig.LoginMethod = digipoauth.LoginMethodFunc(
+				func(ctx context.Context, creds *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+					logins++
+
+					return login.Login(ctx, creds)
+				},
+			)
+			serverConfig.Proxy = true
+			serverConfig.Getter = digiconfig.GetterFunc(func(key string) (string, bool) {
+				if key == digiconfig.APIURLKey {
+					return testServer.URL() + "/v3", true
+				}
+
+				return "", false
+			})
+		})
+
+		JustBeforeEach(func(ctx SpecContext) {
+			var err error
+
+			token, err = cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		get := func(ctx context.Context, bearer string) *http.Response {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, oauthServer.APIProxyURL()+"profile", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			if bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+bearer)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+
+			return resp
+		}
+
+		It("Should forward the request with the Digiposte session", func(ctx SpecContext) {
+			testServer.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest(http.MethodGet, "/v3/profile"),
+				ghttp.VerifyHeaderKV("Authorization", "Bearer access-token"),
+				ghttp.RespondWith(http.StatusOK, "{}"),
+			))
+
+			Expect(get(ctx, token.AccessToken).StatusCode).To(Equal(http.StatusOK))
+			Expect(logins).To(Equal(1))
+		})
+
+		It("Should log in again when Digiposte rejects the session", func(ctx SpecContext) {
+			testServer.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest(http.MethodGet, "/v3/profile"),
+					ghttp.RespondWith(http.StatusUnauthorized, nil),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest(http.MethodGet, "/v3/profile"),
+					ghttp.RespondWith(http.StatusOK, "{}"),
+				),
+			)
+
+			Expect(get(ctx, token.AccessToken).StatusCode).To(Equal(http.StatusOK))
+			Expect(logins).To(Equal(2))
+		})
+
+		It("Should log in again once when Digiposte rejects concurrent requests", func(ctx SpecContext) {
+			var (
+				mutex    sync.Mutex
+				requests int
+			)
+
+			arrived := []chan struct{}{make(chan struct{}), make(chan struct{}), make(chan struct{})}
+
+			// Both requests are sent with the first session. The second one is rejected after the first one is retried.
+			testServer.RouteToHandler(http.MethodGet, "/v3/profile", func(w http.ResponseWriter, _ *http.Request) {
+				mutex.Lock()
+				requests++
+				request := requests
+				mutex.Unlock()
+
+				if request <= len(arrived) {
+					close(arrived[request-1])
+				}
+
+				if request < len(arrived) {
+					<-arrived[request]
+					w.WriteHeader(http.StatusUnauthorized)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			})
+
+			statuses := make(chan int, 2)
+
+			for i := 0; i < 2; i++ {
+				go func() {
+					defer GinkgoRecover()
+
+					statuses <- get(ctx, token.AccessToken).StatusCode
+				}()
+			}
+
+			Expect([]int{<-statuses, <-statuses}).To(Equal([]int{http.StatusOK, http.StatusOK}))
+			Expect(logins).To(Equal(2))
+		})
+
+		It("Should reject requests without a valid token", func(ctx SpecContext) {
+			Expect(get(ctx, "").StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(get(ctx, "unknown").StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("When requesting scopes", func() {
+		const RestrictedClientID = "restricted-client-id"
+
+		JustBeforeEach(func() {
+			Expect(oauthServer.RegisterUser(
+				RestrictedClientID, ClientSecret, testServer.URL(),
+				Username, Password, OTPSecret,
+				&digipoauth.WithScopes{Scopes: []string{digipoauth.ScopeDocumentsRead}},
+			)).To(Succeed())
+		})
+
+		It("Should grant all the scopes of the client by default", func(ctx SpecContext) {
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Extra("scope")).To(Equal(strings.Join(digipoauth.CapabilityScopes, " ")))
+		})
+
+		It("Should record the requested scopes with the token", func(ctx SpecContext) {
+			cfg.Scopes = []string{digipoauth.ScopeDocumentsRead, digipoauth.ScopeShare}
+
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Extra("scope")).To(Equal("documents:read share"))
+
+			resp, err := http.PostForm(oauthServer.IntrospectionURL(), url.Values{ //nolint:noctx
+				"client_id":     {ClientID},
+				"client_secret": {ClientSecret},
+				"token":         {token.AccessToken},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			var introspection digipoauth.IntrospectionResponse
+			Expect(json.NewDecoder(resp.Body).Decode(&introspection)).To(Succeed())
+			Expect(introspection.Scope).To(Equal("documents:read share"))
+		})
+
+		It("Should reject unknown scopes", func() {
+			cfg.Scopes = []string{digipoauth.ScopeDocumentsRead, "unknown"}
+
+			query := authorize()
+			Expect(query.Get("code")).To(BeEmpty())
+			Expect(query.Get("error")).To(Equal("invalid_scope"))
+		})
+
+		It("Should drop the scopes the client is not allowed", func(ctx SpecContext) {
+			cfg.ClientID = RestrictedClientID
+			cfg.Scopes = []string{digipoauth.ScopeDocumentsRead, digipoauth.ScopeShare}
+
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Extra("scope")).To(Equal(digipoauth.ScopeDocumentsRead))
+		})
+
+		It("Should reject a request without any allowed scope", func() {
+			cfg.ClientID = RestrictedClientID
+			cfg.Scopes = []string{digipoauth.ScopeShare}
+
+			query := authorize()
+			Expect(query.Get("code")).To(BeEmpty())
+			Expect(query.Get("error")).To(Equal("invalid_scope"))
+		})
+
+		It("Should restrict the scopes of the client credentials grant", func() {
+			credentials := func(scope string) (int, map[string]interface{}) {
+				resp, err := http.PostForm(oauthServer.TokenURL(), url.Values{ //nolint:noctx
+					"grant_type":    {"client_credentials"},
+					"client_id":     {RestrictedClientID},
+					"client_secret": {ClientSecret},
+					"scope":         {scope},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				defer resp.Body.Close()
+
+				var body map[string]interface{}
+				Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+
+				return resp.StatusCode, body
+			}
+
+			status, body := credentials(digipoauth.ScopeDocumentsWrite + " " + digipoauth.ScopeShare)
+			Expect(status).To(Equal(http.StatusBadRequest))
+			Expect(body).To(HaveKeyWithValue("error", "invalid_scope"))
+
+			status, body = credentials(digipoauth.ScopeDocumentsRead + " " + digipoauth.ScopeDocumentsWrite)
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(HaveKeyWithValue("scope", digipoauth.ScopeDocumentsRead))
+		})
+
+		It("Should not widen the scope of a refreshed token", func(ctx SpecContext) {
+			cfg.Scopes = []string{digipoauth.ScopeDocumentsRead}
+
+			token, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			refresh := func(scope string) *http.Response {
+				resp, err := http.PostForm(oauthServer.TokenURL(), url.Values{ //nolint:noctx
+					"grant_type":    {"refresh_token"},
+					"client_id":     {ClientID},
+					"client_secret": {ClientSecret},
+					"refresh_token": {token.RefreshToken},
+					"scope":         {scope},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.Body.Close()).To(Succeed())
+
+				return resp
+			}
+
+			Expect(refresh(digipoauth.ScopeDocumentsWrite).StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(refresh(digipoauth.ScopeDocumentsRead).StatusCode).To(Equal(http.StatusOK))
+		})
+
+		Context("With the proxy", func() {
+			BeforeEach(func() {
+				serverConfig.Proxy = true
+				// The versions are part of the paths, as with the default API URL.
+				serverConfig.Getter = digiconfig.GetterFunc(func(key string) (string, bool) {
+					if key == digiconfig.APIURLKey {
+						return testServer.URL(), true
+					}
+
+					return "", false
+				})
+			})
+
+			It("Should only forward the requests allowed by the scope", func(ctx SpecContext) {
+				cfg.Scopes = []string{digipoauth.ScopeDocumentsRead}
+
+				token, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+
+				send := func(method, path string) *http.Response {
+					req, err := http.NewRequestWithContext(ctx, method, oauthServer.APIProxyURL()+path, nil)
+					Expect(err).ToNot(HaveOccurred())
+
+					req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+					resp, err := http.DefaultClient.Do(req)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(resp.Body.Close()).To(Succeed())
+
+					return resp
+				}
+
+				testServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, "/v3/folders"),
+						ghttp.RespondWith(http.StatusOK, "{}"),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodPost, "/v3/documents/search"),
+						ghttp.RespondWith(http.StatusOK, "{}"),
+					),
+				)
+
+				Expect(send(http.MethodGet, "v3/folders").StatusCode).To(Equal(http.StatusOK))
+				Expect(send(http.MethodPost, "v3/documents/search").StatusCode).To(Equal(http.StatusOK))
+
+				resp := send(http.MethodPut, "v3/folder")
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+				Expect(resp.Header.Get("WWW-Authenticate")).To(Equal(`Bearer error="insufficient_scope", scope="folders:manage"`))
+
+				resp = send(http.MethodGet, "v3/share/share-id")
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+				Expect(resp.Header.Get("WWW-Authenticate")).To(Equal(`Bearer error="insufficient_scope", scope="share"`))
+
+				Expect(send(http.MethodPost, "v3/share").StatusCode).To(Equal(http.StatusForbidden))
+				Expect(send(http.MethodGet, "v4/partner/user/shares").StatusCode).To(Equal(http.StatusForbidden))
+				Expect(send(http.MethodPost, "v3/documents/copy").StatusCode).To(Equal(http.StatusForbidden))
+				Expect(testServer.ReceivedRequests()).To(HaveLen(3))
+			})
+
+			It("Should not forward the requests of a token without scope", func(ctx SpecContext) {
+				const UnscopedClientID = "unscoped-client-id"
+
+				Expect(oauthServer.RegisterUser(
+					UnscopedClientID, ClientSecret, testServer.URL(),
+					Username, Password, OTPSecret,
+					&digipoauth.WithScopes{Scopes: []string{digipoauth.ScopeOpenID}},
+				)).To(Succeed())
+
+				cfg.ClientID = UnscopedClientID
+
+				token, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(token.Extra("scope")).To(BeNil())
+
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, oauthServer.APIProxyURL()+"v3/folders", nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.Body.Close()).To(Succeed())
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+
+				// Nor can its scope be widened on refresh.
+				resp, err = http.PostForm(oauthServer.TokenURL(), url.Values{ //nolint:noctx
+					"grant_type":    {"refresh_token"},
+					"client_id":     {UnscopedClientID},
+					"client_secret": {ClientSecret},
+					"refresh_token": {token.RefreshToken},
+					"scope":         {digipoauth.ScopeDocumentsRead},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.Body.Close()).To(Succeed())
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			})
+		})
+	})
+
+	Context("When using OpenID Connect", func() {
+		BeforeEach(func() {
+			serverConfig.JWT = &digipoauth.JWTConfig{Dir: GinkgoT().TempDir()}
+			serverConfig.OpenID = true
+			serverConfig.Getter = digiconfig.GetterFunc(func(key string) (string, bool) {
+				if key == digiconfig.APIURLKey {
+					return testServer.URL(), true
+				}
+
+				return "", false
+			})
+		})
+
+		exchange := func(ctx context.Context, opts ...oauth2.AuthCodeOption) *oauth2.Token {
+			token, err := cfg.Exchange(ctx, authorize(opts...).Get("code"))
+			Expect(err).ToNot(HaveOccurred())
+
+			return token
+		}
+
+		userInfo := func(ctx context.Context, bearer string) *http.Response {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, oauthServer.UserInfoURL(), nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			if bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+bearer)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			return resp
+		}
+
+		It("Should issue an ID token for the openid scope", func(ctx SpecContext) {
+			cfg.Scopes = []string{digipoauth.ScopeOpenID, digipoauth.ScopeProfile, digipoauth.ScopeEmail}
+
+			token := exchange(ctx, oauth2.SetAuthURLParam("nonce", "random-nonce"))
+
+			idToken, ok := token.Extra("id_token").(string)
+			Expect(ok).To(BeTrue())
+
+			var claims digipoauth.IDTokenClaims
+			Expect(verifyJWT(keySet(), idToken, &claims)).To(Equal("JWT"))
+
+			digest := sha256.Sum256([]byte(token.AccessToken))
+
+			Expect(claims.Issuer).To(Equal(strings.TrimSuffix(oauthServer.MetadataURL(), digipoauth.MetadataPath)))
+			Expect(claims.Audience).To(Equal(ClientID))
+			Expect(claims.AuthorizedParty).To(Equal(ClientID))
+			Expect(claims.Subject).ToNot(BeEmpty())
+			Expect(claims.Subject).ToNot(ContainSubstring(Username))
+			// The subject is keyed with a persisted secret, so that it cannot be computed from the email address.
+			login := sha256.Sum256([]byte(strings.ToLower(Username)))
+			Expect(claims.Subject).ToNot(Equal(base64.RawURLEncoding.EncodeToString(login[:])))
+			Expect(filepath.Join(serverConfig.JWT.Dir, digipoauth.SubjectKeyFile)).To(BeAnExistingFile())
+			Expect(claims.Nonce).To(Equal("random-nonce"))
+			Expect(claims.AuthTime).ToNot(BeZero())
+			Expect(claims.AccessTokenHash).To(Equal(base64.RawURLEncoding.EncodeToString(digest[:16])))
+			Expect(claims.PreferredUsername).To(Equal(Username))
+			// The login is not an email address.
+			Expect(claims.Email).To(BeEmpty())
+			Expect(time.Unix(claims.ExpiresAt, 0)).To(BeTemporally("~", token.Expiry, 2*time.Second))
+		})
+
+		It("Should discover the issuer of the ID tokens whatever the Host header", func(ctx SpecContext) {
+			cfg.Scopes = []string{digipoauth.ScopeOpenID}
+
+			var claims digipoauth.IDTokenClaims
+			Expect(verifyJWT(keySet(), exchange(ctx).Extra("id_token").(string), &claims)).To(Equal("JWT"))
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+				strings.TrimSuffix(oauthServer.MetadataURL(), digipoauth.MetadataPath)+digipoauth.OpenIDConfigurationPath, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Host = "example.com"
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			var metadata digipoauth.AuthorizationServerMetadata
+			Expect(json.NewDecoder(resp.Body).Decode(&metadata)).To(Succeed())
+			Expect(metadata.Issuer).To(Equal(claims.Issuer))
+		})
+
+		It("Should only add the claims of the granted scopes", func(ctx SpecContext) {
+			cfg.Scopes = []string{digipoauth.ScopeOpenID}
+
+			idToken, ok := exchange(ctx).Extra("id_token").(string)
+			Expect(ok).To(BeTrue())
+
+			var claims digipoauth.IDTokenClaims
+			Expect(verifyJWT(keySet(), idToken, &claims)).To(Equal("JWT"))
+			Expect(claims.Nonce).To(BeEmpty())
+			Expect(claims.PreferredUsername).To(BeEmpty())
+			Expect(claims.Email).To(BeEmpty())
+		})
+
+		It("Should not issue an ID token unless asked for", func(ctx SpecContext) {
+			token := exchange(ctx)
+			Expect(token.Extra("id_token")).To(BeNil())
+			Expect(token.Extra("scope")).ToNot(ContainSubstring(digipoauth.ScopeOpenID))
+
+			resp := userInfo(ctx, token.AccessToken)
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("Should return the Digiposte profile of the token owner", func(ctx SpecContext) {
+			cfg.Scopes = []string{digipoauth.ScopeOpenID, digipoauth.ScopeProfile, digipoauth.ScopeEmail}
+
+			token := exchange(ctx)
+
+			testServer.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest(http.MethodGet, "/v4/profile"),
+				ghttp.VerifyHeaderKV("Authorization", "Bearer access-token"),
+				// The SDK decodes the user information under the UserInfo key.
+				ghttp.RespondWith(http.StatusOK, `{"UserInfo": {
+					"first_name": "Jane",
+					"last_name": "Doe",
+					"login": "jdoe",
+					"primary_email": "jane@example.com"
+				}}`),
+			))
+
+			resp := userInfo(ctx, token.AccessToken)
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			var info digipoauth.UserInfo
+			Expect(json.NewDecoder(resp.Body).Decode(&info)).To(Succeed())
+
+			var claims digipoauth.IDTokenClaims
+			Expect(verifyJWT(keySet(), token.Extra("id_token").(string), &claims)).To(Equal("JWT"))
+
+			Expect(info).To(Equal(digipoauth.UserInfo{
+				Subject:           claims.Subject,
+				PreferredUsername: "jdoe",
+				Name:              "Jane Doe",
+				GivenName:         "Jane",
+				FamilyName:        "Doe",
+				Email:             claims.Email,
+			}))
+			Expect(info.Email).To(BeEmpty())
+		})
+
+		Context("With an email address as login", func() {
+			const (
+				EmailClientID = "email-client-id"
+				EmailLogin    = "jane@example.com"
+			)
+
+			BeforeEach(func() {
+				setter.SetStub = nil
+				serverConfig.LoginMethod = digipoauth.LoginMethodFunc(
+					func(context.Context, *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+						return &oauth2.Token{
+							AccessToken:  "access-token",
+							TokenType:    "token-type",
+							RefreshToken: "",
+							Expiry:       time.Now().Add(time.Hour),
+						}, nil, nil
+					},
+				)
+			})
+
+			JustBeforeEach(func() {
+				Expect(oauthServer.RegisterUser(
+					EmailClientID, ClientSecret, testServer.URL(),
+					EmailLogin, Password, OTPSecret,
+				)).To(Succeed())
+
+				cfg.ClientID = EmailClientID
+			})
+
+			It("Should add the email address to the ID token and the user info", func(ctx SpecContext) {
+				cfg.Scopes = []string{digipoauth.ScopeOpenID, digipoauth.ScopeEmail}
+
+				token := exchange(ctx)
+
+				var claims digipoauth.IDTokenClaims
+				Expect(verifyJWT(keySet(), token.Extra("id_token").(string), &claims)).To(Equal("JWT"))
+				Expect(claims.Email).To(Equal(EmailLogin))
+
+				testServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, `{"UserInfo": {}}`))
+
+				resp := userInfo(ctx, token.AccessToken)
+				defer resp.Body.Close()
+
+				var info map[string]interface{}
+				Expect(json.NewDecoder(resp.Body).Decode(&info)).To(Succeed())
+				Expect(info).To(HaveKeyWithValue("email", EmailLogin))
+				// Digiposte does not tell whether the login was verified.
+				Expect(info).ToNot(HaveKey("email_verified"))
+			})
+		})
+
+		It("Should reject requests without a valid token", func(ctx SpecContext) {
+			resp := userInfo(ctx, "")
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+			resp = userInfo(ctx, "invalid")
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("Should be discoverable", func() {
+			resp, err := http.Get(oauthServer.MetadataURL()) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			var metadata digipoauth.AuthorizationServerMetadata
+			Expect(json.NewDecoder(resp.Body).Decode(&metadata)).To(Succeed())
+			Expect(metadata.UserInfoEndpoint).To(Equal(oauthServer.UserInfoURL()))
+			Expect(metadata.ScopesSupported).To(ContainElements(digipoauth.OpenIDScopes))
+			Expect(metadata.IDTokenSigningAlgValuesSupported).To(ConsistOf("ES256"))
+		})
+
+		It("Should require the signing keys", func() {
+			_, err := digipoauth.NewHandler(setter, &digipoauth.Config{
+				Server: server.NewConfig(),
+				Issuer: "https://example.com",
+				OpenID: true,
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("When disabled", func() {
+			BeforeEach(func() {
+				serverConfig.OpenID = false
+			})
+
+			It("Should reject the openid scope", func() {
+				cfg.Scopes = []string{digipoauth.ScopeOpenID}
+
+				Expect(authorize().Get("error")).To(Equal("invalid_scope"))
+			})
+		})
+	})
+
+	Context("When auditing", func() {
+		var (
+			mutex  sync.Mutex
+			events []*digipoauth.AuditEvent
+			lines  *bytes.Buffer
+		)
+
+		BeforeEach(func() {
+			events = nil
+			lines = &bytes.Buffer{}
+
+			jsonLines := digipoauth.NewJSONLinesAuditSink(lines)
+
+			serverConfig.Audit = &digipoauth.AuditConfig{
+				Path: "",
+				Sink: digipoauth.AuditSinkFunc(func(event *digipoauth.AuditEvent) error {
+					mutex.Lock()
+					events = append(events, event)
+					mutex.Unlock()
+
+					return jsonLines.Record(event)
+				}),
+			}
+		})
+
+		recorded := func(action digipoauth.AuditAction) []*digipoauth.AuditEvent {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			var matching []*digipoauth.AuditEvent
+
+			for _, event := range events {
+				if event.Action == action {
+					matching = append(matching, event)
+				}
+			}
+
+			return matching
+		}
+
+		It("Should record the grant of a token until its revocation", func(ctx SpecContext) {
+			cfg.Scopes = []string{digipoauth.ScopeDocumentsRead}
+
+			code := authorize().Get("code")
+
+			token, err := cfg.Exchange(ctx, code)
+			Expect(err).ToNot(HaveOccurred())
+
+			token.Expiry = time.Now().Add(-time.Minute)
+
+			refreshed, err := cfg.TokenSource(ctx, token).Token()
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := http.PostForm(oauthServer.RevocationURL(), url.Values{ //nolint:noctx
+				"client_id":     {ClientID},
+				"client_secret": {ClientSecret},
+				"token":         {refreshed.AccessToken},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+
+			authorizations := recorded(digipoauth.AuditActionAuthorize)
+			Expect(authorizations).To(HaveLen(1))
+			Expect(authorizations[0].Outcome).To(Equal(digipoauth.AuditOutcomeSuccess))
+			Expect(authorizations[0].ClientID).To(Equal(ClientID))
+			Expect(authorizations[0].Username).To(Equal(Username))
+			Expect(authorizations[0].Scope).To(Equal(digipoauth.ScopeDocumentsRead))
+			Expect(authorizations[0].RemoteAddr).ToNot(BeEmpty())
+
+			exchanges := recorded(digipoauth.AuditActionCodeExchange)
+			Expect(exchanges).To(HaveLen(1))
+			Expect(exchanges[0].Outcome).To(Equal(digipoauth.AuditOutcomeSuccess))
+			Expect(exchanges[0].GrantType).To(Equal("authorization_code"))
+			Expect(exchanges[0].Status).To(Equal(http.StatusOK))
+			Expect(exchanges[0].DurationMS).To(BeNumerically(">", 0))
+
+			refreshes := recorded(digipoauth.AuditActionRefresh)
+			Expect(refreshes).To(HaveLen(1))
+			Expect(refreshes[0].Outcome).To(Equal(digipoauth.AuditOutcomeSuccess))
+
+			revocations := recorded(digipoauth.AuditActionRevocation)
+			Expect(revocations).To(HaveLen(1))
+			Expect(revocations[0].Outcome).To(Equal(digipoauth.AuditOutcomeSuccess))
+
+			logins := recorded(digipoauth.AuditActionLogin)
+			Expect(logins).To(HaveLen(2))
+			Expect(logins[0].Outcome).To(Equal(digipoauth.AuditOutcomeSuccess))
+			Expect(logins[0].Username).To(Equal(Username))
+
+			Expect(strings.Count(lines.String(), "\n")).To(Equal(6))
+
+			for _, secret := range []string{
+				ClientSecret, Password, OTPSecret, code,
+				token.AccessToken, token.RefreshToken, refreshed.AccessToken, refreshed.RefreshToken,
+			} {
+				Expect(lines.String()).ToNot(ContainSubstring(secret))
+			}
+		})
+
+		It("Should record the class of the errors", func(ctx SpecContext) {
+			cfg.ClientSecret = "wrong-secret"
+
+			_, err := cfg.Exchange(ctx, authorize().Get("code"))
+			Expect(err).To(HaveOccurred())
+
+			exchanges := recorded(digipoauth.AuditActionCodeExchange)
+			Expect(exchanges).To(HaveLen(1))
+			Expect(exchanges[0].Outcome).To(Equal(digipoauth.AuditOutcomeFailure))
+			Expect(exchanges[0].Error).To(Equal("invalid_client"))
+			Expect(exchanges[0].ClientID).To(Equal(ClientID))
+
+			Expect(lines.String()).ToNot(ContainSubstring("wrong-secret"))
+		})
+
+		It("Should record the authorizations rejected by the server", func() {
+			cfg.Scopes = []string{"unknown"}
+
+			Expect(authorize().Get("error")).To(Equal("invalid_scope"))
+
+			authorizations := recorded(digipoauth.AuditActionAuthorize)
+			Expect(authorizations).To(HaveLen(1))
+			Expect(authorizations[0].Outcome).To(Equal(digipoauth.AuditOutcomeFailure))
+			Expect(authorizations[0].Error).To(Equal("invalid_scope"))
+		})
+
+		Context("With a failing login method", func() {
+			BeforeEach(func() {
+				serverConfig.LoginMethod = digipoauth.LoginMethodFunc(
+					func(context.Context, *digipoauth.Credentials) (*oauth2.Token, []*http.Cookie, error) {
+						return nil, nil, errors.New("wrong password " + Password)
+					},
+				)
+			})
+
+			It("Should record the failure without its message", func(ctx SpecContext) {
+				_, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).To(HaveOccurred())
+
+				logins := recorded(digipoauth.AuditActionLogin)
+				Expect(logins).To(HaveLen(1))
+				Expect(logins[0].Outcome).To(Equal(digipoauth.AuditOutcomeFailure))
+				Expect(logins[0].Error).To(Equal("login_failed"))
+				Expect(logins[0].Username).To(Equal(Username))
+
+				exchanges := recorded(digipoauth.AuditActionCodeExchange)
+				Expect(exchanges).To(HaveLen(1))
+				Expect(exchanges[0].Outcome).To(Equal(digipoauth.AuditOutcomeFailure))
+
+				Expect(lines.String()).ToNot(ContainSubstring(Password))
+			})
+		})
+
+		Context("With a file", func() {
+			var path string
+
+			BeforeEach(func() {
+				path = filepath.Join(GinkgoT().TempDir(), "audit.jsonl")
+
+				serverConfig.Audit = &digipoauth.AuditConfig{Path: path, Sink: nil}
+			})
+
+			It("Should append the events as JSON lines", func(ctx SpecContext) {
+				_, err := cfg.Exchange(ctx, authorize().Get("code"))
+				Expect(err).ToNot(HaveOccurred())
+
+				content, err := os.ReadFile(path)
+				Expect(err).ToNot(HaveOccurred())
+
+				var actions []digipoauth.AuditAction
+
+				for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+					var event digipoauth.AuditEvent
+					Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+
+					actions = append(actions, event.Action)
+				}
+
+				Expect(actions).To(Equal([]digipoauth.AuditAction{
+					digipoauth.AuditActionAuthorize, digipoauth.AuditActionLogin, digipoauth.AuditActionCodeExchange,
+				}))
+			})
+		})
+	})
+
+	Context("When validating redirect URIs", func() {
+		const nativeClientID = "native"
+
+		var noRedirect *http.Client
+
+		JustBeforeEach(func() {
+			Expect(oauthServer.RegisterUser(
+				nativeClientID, "", "http://127.0.0.1/callback",
+				Username, Password, OTPSecret,
+				&digipoauth.WithPublicClient{},
+				&digipoauth.WithRedirectURIs{URIs: []string{"https://app.example.com/callback"}},
+			)).To(Succeed())
+
+			noRedirect = &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+		})
+
+		authorizeNative := func(redirectURI string) *http.Response {
+			params := url.Values{
+				"client_id":             {nativeClientID},
+				"response_type":         {"code"},
+				"state":                 {"tests"},
+				"code_challenge":        {oauth2.S256ChallengeFromVerifier(oauth2.GenerateVerifier())},
+				"code_challenge_method": {"S256"},
+			}
+
+			if redirectURI != "" {
+				params.Set("redirect_uri", redirectURI)
+			}
+
+			resp, err := noRedirect.Get(oauthServer.AuthorizeURL() + "?" + params.Encode()) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+
+			return resp
+		}
+
+		errorOf := func(resp *http.Response) string {
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			var body map[string]string
+			Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+
+			return body["error"]
+		}
+
+		It("Should accept any registered redirect URI", func() {
+			resp := authorizeNative("https://app.example.com/callback")
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusFound))
+			Expect(resp.Header.Get("Location")).To(HavePrefix("https://app.example.com/callback?code="))
+		})
+
+		It("Should accept any port of a loopback redirect URI", func() {
+			resp := authorizeNative("http://127.0.0.1:51234/callback")
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusFound))
+			Expect(resp.Header.Get("Location")).To(HavePrefix("http://127.0.0.1:51234/callback?code="))
+		})
+
+		It("Should reject unregistered redirect URIs without redirecting", func() {
+			Expect(errorOf(authorizeNative("https://app.example.com/callback/other"))).To(Equal("invalid_request"))
+			Expect(errorOf(authorizeNative("https://app.example.com.evil.com/callback"))).To(Equal("invalid_request"))
+			Expect(errorOf(authorizeNative("http://127.0.0.1:51234/other"))).To(Equal("invalid_request"))
+		})
+
+		It("Should require the redirect URI when several are registered", func() {
+			Expect(errorOf(authorizeNative(""))).To(Equal("invalid_request"))
+		})
+
+		It("Should reject unknown clients without redirecting", func() {
+			resp, err := noRedirect.Get(oauthServer.AuthorizeURL() + "?" + url.Values{ //nolint:noctx
+				"client_id":     {"unknown"},
+				"response_type": {"code"},
+				"redirect_uri":  {"https://evil.com/callback"},
+			}.Encode())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(errorOf(resp)).To(Equal("invalid_client"))
+		})
+	})
+
+	Context("When asking for consent", func() {
+		const passphrase = "passphrase"
+
+		var noRedirect *http.Client
+
+		BeforeEach(func() {
+			serverConfig.Consent = &digipoauth.ConsentConfig{
+				Passphrase:   passphrase,
+				RememberFor:  0,
+				RememberPath: "",
+			}
+
+			noRedirect = &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+		})
+
+		hiddenField := regexp.MustCompile(`<input type="hidden" name="([^"]+)" value="([^"]*)">`)
+
+		// consentForm requests the consent page and returns its form.
+		consentForm := func() url.Values {
+			resp, err := noRedirect.Get(cfg.AuthCodeURL("tests", oauth2.SetAuthURLParam("scope", "documents:read"))) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("X-Frame-Options")).To(Equal("DENY"))
+
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(Username))
+			Expect(string(body)).To(ContainSubstring("documents:read"))
+
+			form := url.Values{}
+			for _, match := range hiddenField.FindAllStringSubmatch(string(body), -1) {
+				form.Add(match[1], html.UnescapeString(match[2]))
+			}
+
+			return form
+		}
+
+		submit := func(form url.Values) *http.Response {
+			resp, err := noRedirect.PostForm(oauthServer.AuthorizeURL(), form) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+
+			return resp
+		}
+
+		It("Should issue a code once approved with the passphrase", func() {
+			form := consentForm()
+			form.Set("consent_action", "approve")
+
+			form.Set("consent_passphrase", "wrong")
+			Expect(submit(form).StatusCode).To(Equal(http.StatusForbidden))
+
+			form.Set("consent_passphrase", passphrase)
+			resp := submit(form)
+			Expect(resp.StatusCode).To(Equal(http.StatusFound))
+
+			location, err := resp.Location()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(location.Query().Get("code")).ToNot(BeEmpty())
+		})
+
+		It("Should report a denied request to the client", func() {
+			form := consentForm()
+			form.Set("consent_action", "deny")
+
+			resp := submit(form)
+			Expect(resp.StatusCode).To(Equal(http.StatusFound))
+
+			location, err := resp.Location()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(location.Query().Get("error")).To(Equal("access_denied"))
+		})
+
+		It("Should reject a tampered form", func() {
+			form := consentForm()
+			form.Set("consent_action", "approve")
+			form.Set("consent_passphrase", passphrase)
+			form.Set("scope", "documents:read documents:write")
+
+			Expect(submit(form).StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("Should remember the decision", func() {
+			form := consentForm()
+			form.Set("consent_action", "approve")
+			form.Set("consent_passphrase", passphrase)
+			form.Set("consent_remember", "1")
+			Expect(submit(form).StatusCode).To(Equal(http.StatusFound))
+
+			Expect(authorize(oauth2.SetAuthURLParam("scope", "documents:read")).Get("code")).ToNot(BeEmpty())
+		})
+	})
+
+	Context("When using the device authorization grant", func() {
+		const passphrase = "passphrase"
+
+		BeforeEach(func() {
+			serverConfig.Device = &digipoauth.DeviceConfig{
+				CodeExp:  time.Minute,
+				Interval: time.Second,
+			}
+			serverConfig.Consent = &digipoauth.ConsentConfig{
+				Passphrase:   passphrase,
+				RememberFor:  0,
+				RememberPath: "",
+			}
+		})
+
+		JustBeforeEach(func() {
+			cfg.Endpoint.DeviceAuthURL = oauthServer.DeviceAuthorizationURL()
+		})
+
+		deviceAuth := func(ctx context.Context) *oauth2.DeviceAuthResponse {
+			response, err := cfg.DeviceAuth(ctx, oauth2.SetAuthURLParam("client_secret", ClientSecret))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(response.UserCode).ToNot(BeEmpty())
+			Expect(response.VerificationURIComplete).To(HaveSuffix(url.Values{"user_code": {response.UserCode}}.Encode()))
+
+			return response
+		}
+
+		hiddenField := regexp.MustCompile(`<input type="hidden" name="([^"]+)" value="([^"]*)">`)
+
+		// verificationForm requests the verification page of the user code and returns its form.
+		verificationForm := func(verificationURI string) (url.Values, int) {
+			resp, err := http.Get(verificationURI) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).ToNot(ContainSubstring(Username))
+
+			form := url.Values{}
+			for _, match := range hiddenField.FindAllStringSubmatch(string(body), -1) {
+				form.Add(match[1], html.UnescapeString(match[2]))
+			}
+
+			return form, resp.StatusCode
+		}
+
+		submit := func(response *oauth2.DeviceAuthResponse, form url.Values) int {
+			resp, err := http.PostForm(response.VerificationURI, form) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+
+			return resp.StatusCode
+		}
+
+		decide := func(response *oauth2.DeviceAuthResponse, action string) {
+			form, status := verificationForm(response.VerificationURIComplete)
+			Expect(status).To(Equal(http.StatusOK))
+
+			form.Set("action", action)
+			form.Set("passphrase", passphrase)
+			Expect(submit(response, form)).To(Equal(http.StatusOK))
+		}
+
+		It("Should issue a token once approved", func(ctx SpecContext) {
+			response := deviceAuth(ctx)
+
+			decide(response, "approve")
+
+			token, err := cfg.DeviceAccessToken(ctx, response)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Valid()).To(BeTrue())
+		}, SpecTimeout(10*time.Second))
+
+		It("Should not take the verification URI from the Host header", func(ctx SpecContext) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, oauthServer.DeviceAuthorizationURL(),
+				strings.NewReader(url.Values{"client_id": {ClientID}, "client_secret": {ClientSecret}}.Encode()))
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Host = "example.com"
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			var response digipoauth.DeviceAuthorizationResponse
+			Expect(json.NewDecoder(resp.Body).Decode(&response)).To(Succeed())
+			Expect(response.VerificationURI).To(Equal(
+				strings.TrimSuffix(oauthServer.MetadataURL(), digipoauth.MetadataPath) + digipoauth.DeviceVerificationPath,
+			))
+		})
+
+		It("Should require the form token", func(ctx SpecContext) {
+			response := deviceAuth(ctx)
+
+			Expect(submit(response, url.Values{
+				"user_code":  {strings.ToLower(response.UserCode)},
+				"action":     {"approve"},
+				"passphrase": {passphrase},
+			})).To(Equal(http.StatusForbidden))
+		})
+
+		It("Should require the passphrase", func(ctx SpecContext) {
+			response := deviceAuth(ctx)
+
+			form, _ := verificationForm(response.VerificationURIComplete)
+			form.Set("action", "approve")
+			form.Set("passphrase", "wrong")
+			Expect(submit(response, form)).To(Equal(http.StatusForbidden))
+
+			form.Set("passphrase", passphrase)
+			Expect(submit(response, form)).To(Equal(http.StatusOK))
+		})
+
+		It("Should approve a device only once", func(ctx SpecContext) {
+			response := deviceAuth(ctx)
+
+			form, _ := verificationForm(response.VerificationURIComplete)
+			form.Set("action", "approve")
+			form.Set("passphrase", passphrase)
+
+			statuses := make(chan int, 2)
+
+			for i := 0; i < 2; i++ {
+				go func() {
+					defer GinkgoRecover()
+
+					statuses <- submit(response, form)
+				}()
+			}
+
+			Expect([]int{<-statuses, <-statuses}).To(ConsistOf(http.StatusOK, http.StatusNotFound))
+		})
+
+		It("Should lock the page after too many invalid codes", func(ctx SpecContext) {
+			response := deviceAuth(ctx)
+
+			for i := 0; i < 10; i++ {
+				_, status := verificationForm(response.VerificationURI + "?user_code=BBBB-BBBB")
+				Expect(status).To(Equal(http.StatusNotFound))
+			}
+
+			_, status := verificationForm(response.VerificationURIComplete)
+			Expect(status).To(Equal(http.StatusTooManyRequests))
+		})
+
+		It("Should not lock the page for the other clients", func(ctx SpecContext) {
+			response := deviceAuth(ctx)
+
+			for i := 0; i < 10; i++ {
+				_, status := verificationForm(response.VerificationURI + "?user_code=BBBB-BBBB")
+				Expect(status).To(Equal(http.StatusNotFound))
+			}
+
+			// Another loopback address stands for another client.
+			otherClient := &http.Client{
+				Transport: &http.Transport{
+					DialContext: (&net.Dialer{
+						LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)},
+					}).DialContext,
+				},
+			}
+
+			resp, err := otherClient.Get(response.VerificationURIComplete) //nolint:noctx
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			_, status := verificationForm(response.VerificationURIComplete)
+			Expect(status).To(Equal(http.StatusTooManyRequests))
+		})
+
+		It("Should report a denied device", func(ctx SpecContext) {
+			response := deviceAuth(ctx)
+
+			decide(response, "deny")
+
+			_, err := cfg.DeviceAccessToken(ctx, response)
+			Expect(err).To(MatchError(ContainSubstring("access_denied")))
+		}, SpecTimeout(10*time.Second))
+
+		It("Should ask the device to wait", func(ctx SpecContext) {
+			response := deviceAuth(ctx)
+
+			poll := func() string {
+				resp, err := http.PostForm(oauthServer.TokenURL(), url.Values{ //nolint:noctx
+					"grant_type":    {digipoauth.DeviceCodeGrantType},
+					"device_code":   {response.DeviceCode},
+					"client_id":     {ClientID},
+					"client_secret": {ClientSecret},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				defer resp.Body.Close()
+
+				var body map[string]string
+				Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+
+				return body["error"]
+			}
+
+			Expect(poll()).To(Equal("authorization_pending"))
+			Expect(poll()).To(Equal("slow_down"))
+		})
+
+		Context("With the audit log", func() {
+			var (
+				mutex  sync.Mutex
+				events []*digipoauth.AuditEvent
+			)
+
+			BeforeEach(func() {
+				events = nil
+
+				serverConfig.Audit = &digipoauth.AuditConfig{
+					Path: "",
+					Sink: digipoauth.AuditSinkFunc(func(event *digipoauth.AuditEvent) error {
+						mutex.Lock()
+						defer mutex.Unlock()
+
+						if event.Action == digipoauth.AuditActionDeviceAuthorization ||
+							event.Action == digipoauth.AuditActionDeviceVerification {
+							events = append(events, event)
+						}
+
+						return nil
+					}),
+				}
+			})
+
+			recorded := func() []string {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				recorded := make([]string, 0, len(events))
+
+				for _, event := range events {
+					Expect(event.ClientID).To(Equal(ClientID))
+					Expect(event.Username).To(Equal(Username))
+
+					recorded = append(recorded, string(event.Action)+" "+string(event.Outcome))
+				}
+
+				return recorded
+			}
+
+			It("Should record the authorization and the decision", func(ctx SpecContext) {
+				response := deviceAuth(ctx)
+
+				decide(response, "deny")
+
+				Eventually(recorded).Should(Equal([]string{
+					"device_authorization success",
+					"device_verification pending",
+					"device_verification denied",
+				}))
+			})
+
+			It("Should record the failed verifications", func(ctx SpecContext) {
+				response := deviceAuth(ctx)
+
+				form, _ := verificationForm(response.VerificationURIComplete)
+				form.Set("action", "approve")
+				form.Set("passphrase", "wrong")
+				Expect(submit(response, form)).To(Equal(http.StatusForbidden))
+
+				form.Set("passphrase", passphrase)
+				Expect(submit(response, form)).To(Equal(http.StatusOK))
+
+				Eventually(recorded).Should(Equal([]string{
+					"device_authorization success",
+					"device_verification pending",
+					"device_verification failure",
+					"device_verification success",
+				}))
+			})
+		})
+	})
+})
+
+// jwtKeyID returns the kid header of the token.
+func jwtKeyID(token string) string {
+	content, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	Expect(err).ToNot(HaveOccurred())
+
+	var header struct {
+		KeyID string `json:"kid"`
+	}
+	Expect(json.Unmarshal(content, &header)).To(Succeed())
+
+	return header.KeyID
+}
+
+// verifyJWT verifies the ES256 signature of the token with the key set, decodes its claims and returns its type.
+func verifyJWT(keys *digipoauth.JSONWebKeySet, token string, claims interface{}) string {
+	parts := strings.Split(token, ".")
+	Expect(parts).To(HaveLen(3))
+
+	decode := func(part string) []byte {
+		content, err := base64.RawURLEncoding.DecodeString(part)
+		Expect(err).ToNot(HaveOccurred())
+
+		return content
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+		Type      string `json:"typ"`
+	}
+	Expect(json.Unmarshal(decode(parts[0]), &header)).To(Succeed())
+	Expect(header.Algorithm).To(Equal("ES256"))
+
+	var key *digipoauth.JSONWebKey
+
+	for _, candidate := range keys.Keys {
+		if candidate.KeyID == header.KeyID {
+			key = candidate
+		}
+	}
+
+	Expect(key).ToNot(BeNil(), "unknown key %q", header.KeyID)
+
+	publicKey := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(decode(key.X)),
+		Y:     new(big.Int).SetBytes(decode(key.Y)),
+	}
+
+	signature := decode(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	Expect(ecdsa.Verify(
+		publicKey, digest[:],
+		new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]),
+	)).To(BeTrue())
+
+	Expect(json.Unmarshal(decode(parts[1]), claims)).To(Succeed())
+
+	return header.Type
+}
+
+// signAssertion signs a client assertion for the private_key_jwt method.
+func signAssertion(key *ecdsa.PrivateKey, clientID, audience string) string {
+	encode := func(value interface{}) string {
+		content, err := json.Marshal(value)
+		Expect(err).ToNot(HaveOccurred())
+
+		return base64.RawURLEncoding.EncodeToString(content)
+	}
+
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
+	Expect(err).ToNot(HaveOccurred())
+
+	signed := encode(map[string]string{"alg": "ES256", "typ": "JWT"}) + "." + encode(map[string]interface{}{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": audience,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"jti": base64.RawURLEncoding.EncodeToString(jti),
+	})
+
+	digest := sha256.Sum256([]byte(signed))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	Expect(err).ToNot(HaveOccurred())
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+type renewingLoginMethod struct {
+	digipoauth.LoginMethod
+
+	renew func(ctx context.Context, creds *digipoauth.Credentials, cookies []*http.Cookie) (*oauth2.Token, []*http.Cookie, error)
+}
+
+func (m *renewingLoginMethod) Renew(
+	ctx context.Context,
+	creds *digipoauth.Credentials,
+	cookies []*http.Cookie,
+) (*oauth2.Token, []*http.Cookie, error) {
+	return m.renew(ctx, creds, cookies)
+}
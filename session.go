@@ -0,0 +1,124 @@
+package digipoauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/holyhope/digiposte-go-sdk/v1"
+	digiconfig "github.com/holyhope/digiposte-oauth/config"
+	"golang.org/x/oauth2"
+)
+
+// session is the result of a login to Digiposte.
+type session struct {
+	Token   *oauth2.Token
+	Cookies []*http.Cookie
+}
+
+// sessionTransport authenticates the requests with the token and the cookies of a session.
+type sessionTransport struct {
+	session *session
+	base    http.RoundTripper
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	t.session.authenticate(req)
+
+	return t.base.RoundTrip(req) //nolint:wrapcheck
+}
+
+// authenticate sets the bearer token and the matching cookies of the session to the request.
+func (s *session) authenticate(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+s.Token.AccessToken)
+
+	for _, cookie := range s.Cookies {
+		if cookieMatchesHost(cookie, req.URL.Hostname()) {
+			req.AddCookie(&http.Cookie{
+				Name:  cookie.Name,
+				Value: cookie.Value,
+
+				Path:       "",
+				Domain:     "",
+				Expires:    cookie.Expires,
+				RawExpires: "",
+				MaxAge:     0,
+				Secure:     false,
+				HttpOnly:   false,
+				SameSite:   http.SameSiteDefaultMode,
+				Raw:        "",
+				Unparsed:   nil,
+			})
+		}
+	}
+}
+
+func cookieMatchesHost(cookie *http.Cookie, host string) bool {
+	domain := strings.TrimPrefix(cookie.Domain, ".")
+	if domain == "" || domain == host {
+		return true
+	}
+
+	return strings.HasSuffix(host, "."+domain)
+}
+
+func newDigiposteClient(getter digiconfig.Getter, session *session) (*digiposte.Client, error) {
+	client, err := digiposte.NewCustomClient(
+		digiconfig.APIURL(getter),
+		digiconfig.DocumentURL(getter),
+		&http.Client{
+			Transport: &sessionTransport{
+				session: session,
+				base:    http.DefaultTransport,
+			},
+			CheckRedirect: nil,
+			Jar:           nil,
+			Timeout:       0,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new digiposte client: %w", err)
+	}
+
+	return client, nil
+}
+
+// logout ends the session on Digiposte.
+func (s *session) logout(ctx context.Context, getter digiconfig.Getter) error {
+	client, err := newDigiposteClient(getter, s)
+	if err != nil {
+		return err
+	}
+
+	// The client tries to decode the empty body of the successful response.
+	if err := client.Logout(ctx); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("logout: %w", err)
+	}
+
+	return nil
+}
+
+// profile fetches the Digiposte profile of the account of the session.
+func (s *session) profile(ctx context.Context, getter digiconfig.Getter) (*digiposte.Profile, error) {
+	client, err := newDigiposteClient(getter, s)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := client.GetProfile(ctx, digiposte.ProfileModeNoSpaceConsumption)
+	if err != nil {
+		return nil, fmt.Errorf("get profile: %w", err)
+	}
+
+	return profile, nil
+}
+
+// emptyGetter is used when no configuration is provided, so that the default values are used.
+var emptyGetter = digiconfig.GetterFunc(func(string) (string, bool) { //nolint:gochecknoglobals
+	return "", false
+})
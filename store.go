@@ -0,0 +1,211 @@
+package digipoauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/store"
+)
+
+// ClientStore is an oauth2.ClientStore in which clients can be registered.
+type ClientStore interface {
+	oauth2.ClientStore
+	Set(id string, cli oauth2.ClientInfo) error
+}
+
+// ManagedClientStore is a ClientStore whose clients can also be listed and deleted,
+// as required by the admin API and the clients file.
+type ManagedClientStore interface {
+	ClientStore
+	Delete(id string) error
+	List() ([]oauth2.ClientInfo, error)
+}
+
+var (
+	_ ClientStore        = (*store.ClientStore)(nil)
+	_ ManagedClientStore = (*FileClientStore)(nil)
+)
+
+// ErrUnmanagedClientStore is returned when listing or deleting the clients of a store which does not support it.
+var ErrUnmanagedClientStore = errors.New("the client store cannot list or delete clients")
+
+// NewMemoryTokenStore returns a token store that lives in memory.
+func NewMemoryTokenStore() (oauth2.TokenStore, error) { //nolint:ireturn
+	return NewFileTokenStore(":memory:")
+}
+
+// NewFileTokenStore returns a token store persisted to the given file.
+// Entries expire on their own and the store is safe for concurrent use.
+func NewFileTokenStore(path string) (oauth2.TokenStore, error) { //nolint:ireturn
+	tokenStore, err := store.NewFileTokenStore(path)
+	if err != nil {
+		return nil, fmt.Errorf("open %q: %w", path, err)
+	}
+
+	return tokenStore, nil
+}
+
+// FileClientStore is a ClientStore persisted to a JSON file, or kept in memory if it has no path.
+type FileClientStore struct {
+	path string
+
+	mutex   sync.RWMutex
+	clients map[string]*Client
+}
+
+// NewMemoryClientStore returns a client store that lives in memory.
+func NewMemoryClientStore() *FileClientStore {
+	return &FileClientStore{
+		path:    "",
+		mutex:   sync.RWMutex{},
+		clients: make(map[string]*Client),
+	}
+}
+
+// NewFileClientStore returns a client store persisted to the given file.
+// The file is created on the first write if it does not exist.
+func NewFileClientStore(path string) (*FileClientStore, error) {
+	clientStore := &FileClientStore{
+		path:    path,
+		mutex:   sync.RWMutex{},
+		clients: make(map[string]*Client),
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return clientStore, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("read %q: %w", path, err)
+	}
+
+	if err := json.Unmarshal(content, &clientStore.clients); err != nil {
+		return nil, fmt.Errorf("unmarshal %q: %w", path, err)
+	}
+
+	return clientStore, nil
+}
+
+// GetByID returns the client with the given ID, or nil if it does not exist.
+func (s *FileClientStore) GetByID(_ context.Context, id string) (oauth2.ClientInfo, error) { //nolint:ireturn
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return nil, nil //nolint:nilnil
+	}
+
+	return toClient(client), nil
+}
+
+// Set stores the client and persists the store to its file.
+func (s *FileClientStore) Set(id string, cli oauth2.ClientInfo) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, existed := s.clients[id]
+
+	s.clients[id] = toClient(cli)
+
+	if err := s.save(); err != nil {
+		if existed {
+			s.clients[id] = previous
+		} else {
+			delete(s.clients, id)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes the client and persists the store to its file. Unknown clients are ignored.
+func (s *FileClientStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, existed := s.clients[id]
+	if !existed {
+		return nil
+	}
+
+	delete(s.clients, id)
+
+	if err := s.save(); err != nil {
+		s.clients[id] = previous
+
+		return err
+	}
+
+	return nil
+}
+
+// List returns the clients sorted by ID.
+func (s *FileClientStore) List() ([]oauth2.ClientInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	clients := make([]oauth2.ClientInfo, 0, len(s.clients))
+
+	for _, client := range s.clients {
+		clients = append(clients, toClient(client))
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].GetID() < clients[j].GetID()
+	})
+
+	return clients, nil
+}
+
+// save persists the clients, unless the store lives in memory.
+func (s *FileClientStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(s.clients, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	return writeFileAtomic(s.path, content)
+}
+
+// writeFileAtomic writes the content to a temporary file (created with 0600 permissions) then renames it,
+// so that the file is never partially written.
+func writeFileAtomic(path string, content []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+
+	defer os.Remove(tmpFile.Name()) //nolint:errcheck
+
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+
+		return fmt.Errorf("write %q: %w", tmpFile.Name(), err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("close %q: %w", tmpFile.Name(), err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("rename %q: %w", tmpFile.Name(), err)
+	}
+
+	return nil
+}
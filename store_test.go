@@ -0,0 +1,76 @@
+package digipoauth_test
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4/models"
+	digipoauth "github.com/holyhope/digiposte-oauth"
+	. "github.com/onsi/ginkgo/v2" //nolint:revive
+	. "github.com/onsi/gomega"    //nolint:revive
+)
+
+var _ = Describe("Stores", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	Describe("FileClientStore", func() {
+		It("Should keep clients across reopening", func(ctx SpecContext) {
+			path := filepath.Join(dir, "clients.json")
+
+			clientStore, err := digipoauth.NewFileClientStore(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(clientStore.Set(ClientID, &models.Client{
+				ID:     ClientID,
+				Secret: ClientSecret,
+				Domain: "http://localhost",
+				Public: false,
+				UserID: ClientID,
+			})).To(Succeed())
+
+			reopened, err := digipoauth.NewFileClientStore(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			client, err := reopened.GetByID(ctx, ClientID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.GetSecret()).To(Equal(ClientSecret))
+			Expect(client.GetDomain()).To(Equal("http://localhost"))
+		})
+
+		It("Should return nil for unknown clients", func(ctx SpecContext) {
+			clientStore, err := digipoauth.NewFileClientStore(filepath.Join(dir, "clients.json"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(clientStore.GetByID(ctx, "unknown")).To(BeNil())
+		})
+	})
+
+	Describe("FileTokenStore", func() {
+		It("Should keep tokens across reopening", func(ctx SpecContext) {
+			path := filepath.Join(dir, "tokens.db")
+
+			tokenStore, err := digipoauth.NewFileTokenStore(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			token := models.NewToken()
+			token.SetClientID(ClientID)
+			token.SetAccess("access-token")
+			token.SetAccessCreateAt(time.Now())
+			token.SetAccessExpiresIn(time.Hour)
+
+			Expect(tokenStore.Create(ctx, token)).To(Succeed())
+
+			reopened, err := digipoauth.NewFileTokenStore(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			info, err := reopened.GetByAccess(ctx, "access-token")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info).ToNot(BeNil())
+			Expect(info.GetClientID()).To(Equal(ClientID))
+		})
+	})
+})
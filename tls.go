@@ -0,0 +1,260 @@
+package digipoauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// CACertificateFile is the name of the generated CA certificate, to be trusted by the clients.
+	CACertificateFile = "ca.pem"
+	// CAKeyFile is the name of the generated CA private key.
+	CAKeyFile = "ca-key.pem"
+	// CertificateFile is the name of the generated server certificate.
+	CertificateFile = "cert.pem"
+	// KeyFile is the name of the generated server private key.
+	KeyFile = "key.pem"
+
+	// CAValidity is the validity of the generated CA certificate.
+	CAValidity = 10 * 365 * 24 * time.Hour
+	// CertificateValidity is the validity of the generated server certificate.
+	CertificateValidity = 365 * 24 * time.Hour
+	// CertificateRenewBefore is the remaining validity under which the server certificate is generated again.
+	CertificateRenewBefore = 30 * 24 * time.Hour
+)
+
+// TLSConfig enables HTTPS.
+// Either CertFile and KeyFile are provided, or a self-signed CA and a certificate are generated in Dir.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate and key to serve.
+	CertFile string
+	KeyFile  string
+
+	// Dir is where the self-signed CA and server certificate are persisted, if CertFile is empty.
+	// The CA is generated once, so that the clients trust it only once.
+	Dir string
+	// Hosts are the DNS names and IP addresses of the generated certificate.
+	// Defaults to localhost, the loopback addresses and the host name of the machine.
+	Hosts []string
+}
+
+var errMissingTLSFiles = errors.New("either a certificate and a key or a directory is required")
+
+// newTLSConfig loads or generates the certificate to serve.
+func newTLSConfig(config *TLSConfig, addrs []string) (*tls.Config, error) {
+	if config == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	var (
+		certificate tls.Certificate
+		err         error
+	)
+
+	switch {
+	case config.CertFile != "" && config.KeyFile != "":
+		certificate, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	case config.Dir != "":
+		certificate, err = selfSignedCertificate(config.Dir, certificateHosts(config.Hosts, addrs))
+	default:
+		err = errMissingTLSFiles
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("certificate: %w", err)
+	}
+
+	return &tls.Config{ //nolint:exhaustruct
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}, nil
+}
+
+func certificateHosts(hosts []string, addrs []string) []string {
+	if len(hosts) > 0 {
+		return hosts
+	}
+
+	hosts = []string{"localhost", "127.0.0.1", "::1"}
+
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+
+	for _, addr := range addrs {
+		if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+// selfSignedCertificate loads the server certificate from dir, generating the CA and the certificate if needed.
+func selfSignedCertificate(dir string, hosts []string) (tls.Certificate, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil { //nolint:gomnd
+		return tls.Certificate{}, fmt.Errorf("create directory: %w", err)
+	}
+
+	certFile := filepath.Join(dir, CertificateFile)
+	keyFile := filepath.Join(dir, KeyFile)
+
+	if certificate, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && isCertificateUsable(&certificate) {
+		return certificate, nil
+	}
+
+	caCert, caKey, err := loadOrGenerateCA(dir)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("CA: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %w", err)
+	}
+
+	template, err := newCertificateTemplate("digiposte-oauth", CertificateValidity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create certificate: %w", err)
+	}
+
+	if err := writePEM(certFile, "CERTIFICATE", der); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := writeKey(keyFile, key); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.LoadX509KeyPair(certFile, keyFile) //nolint:wrapcheck
+}
+
+func isCertificateUsable(certificate *tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return false
+	}
+
+	return time.Until(leaf.NotAfter) > CertificateRenewBefore
+}
+
+func loadOrGenerateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile := filepath.Join(dir, CACertificateFile)
+	keyFile := filepath.Join(dir, CAKeyFile)
+
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		caCert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse: %w", err)
+		}
+
+		caKey, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if ok && time.Now().Before(caCert.NotAfter) {
+			return caCert, caKey, nil
+		}
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	template, err := newCertificateTemplate("digiposte-oauth CA", CAValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create certificate: %w", err)
+	}
+
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse: %w", err)
+	}
+
+	if err := writePEM(certFile, "CERTIFICATE", der); err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeKey(keyFile, caKey); err != nil {
+		return nil, nil, err
+	}
+
+	return caCert, caKey, nil
+}
+
+func newCertificateTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)) //nolint:gomnd
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %w", err)
+	}
+
+	now := time.Now()
+
+	return &x509.Certificate{ //nolint:exhaustruct
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{ //nolint:exhaustruct
+			CommonName:   commonName,
+			Organization: []string{"digiposte-oauth"},
+		},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal key: %w", err)
+	}
+
+	return writePEM(path, "EC PRIVATE KEY", der)
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:    blockType,
+		Headers: nil,
+		Bytes:   der,
+	})
+
+	if err := os.WriteFile(path, data, 0o600); err != nil { //nolint:gomnd
+		return fmt.Errorf("write %s: %w", filepath.Base(path), err)
+	}
+
+	return nil
+}
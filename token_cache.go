@@ -0,0 +1,100 @@
+package digipoauth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultTokenCacheMinRemaining is the default minimum remaining lifetime of the cached Digiposte tokens.
+const DefaultTokenCacheMinRemaining = 5 * time.Minute
+
+var errTokenCacheWithoutJWT = errors.New("the token cache requires JWT, " +
+	"otherwise the grants sharing a cached Digiposte token would share their access token")
+
+// TokenCacheConfig configures the reuse of the last Digiposte token of each account.
+// Zero values are replaced by the defaults.
+type TokenCacheConfig struct {
+	// MinRemaining is the minimum remaining lifetime of the cached token for it to be reused.
+	MinRemaining time.Duration
+}
+
+// tokenCache keeps the last Digiposte session of each account,
+// so that the code exchanges are served without a login while the token is valid.
+type tokenCache struct {
+	minRemaining time.Duration
+
+	mutex    sync.Mutex
+	sessions map[Credentials]*session
+}
+
+func newTokenCache(config *TokenCacheConfig) *tokenCache {
+	if config == nil {
+		return nil
+	}
+
+	minRemaining := config.MinRemaining
+	if minRemaining <= 0 {
+		minRemaining = DefaultTokenCacheMinRemaining
+	}
+
+	return &tokenCache{
+		minRemaining: minRemaining,
+		mutex:        sync.Mutex{},
+		sessions:     make(map[Credentials]*session),
+	}
+}
+
+// get returns a copy of the cached session of the account, if its token lives long enough.
+func (c *tokenCache) get(creds *Credentials) (*session, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached, ok := c.sessions[*creds]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Until(cached.Token.Expiry) < c.minRemaining {
+		delete(c.sessions, *creds)
+
+		return nil, false
+	}
+
+	token := *cached.Token
+	// Each grant gets its own refresh token.
+	token.RefreshToken = ""
+
+	return &session{
+		Token:   &token,
+		Cookies: cached.Cookies,
+	}, true
+}
+
+// put caches the session of the account.
+// Tokens without expiry are never cached, as nothing tells when they stop being valid.
+func (c *tokenCache) put(creds *Credentials, current *session) {
+	if current.Token.Expiry.IsZero() {
+		c.invalidate(creds)
+
+		return
+	}
+
+	token := *current.Token
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.sessions[*creds] = &session{
+		Token:   &token,
+		Cookies: current.Cookies,
+	}
+}
+
+// invalidate drops the cached session of the account.
+func (c *tokenCache) invalidate(creds *Credentials) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.sessions, *creds)
+}
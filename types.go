@@ -35,6 +35,13 @@ func (f LoginMethodFunc) Login(ctx context.Context, creds *Credentials) (*oauth2
 	return f(ctx, creds)
 }
 
+// SessionRenewer is implemented by the login methods able to renew a Digiposte session from
+// the cookies of a previous login, which is cheaper than a full login.
+// The access generator falls back to LoginMethod.Login when the renewal fails.
+type SessionRenewer interface {
+	Renew(ctx context.Context, creds *Credentials, cookies []*http.Cookie) (*oauth2.Token, []*http.Cookie, error)
+}
+
 type InvalidOptionError struct {
 	Name string
 	Err  error
@@ -51,3 +58,11 @@ func (e *InvalidOptionError) Unwrap() error {
 func (e *InvalidOptionError) Apply(interface{}) error {
 	return e
 }
+
+type InvalidTypeOptionError struct {
+	instance interface{}
+}
+
+func (e *InvalidTypeOptionError) Error() string {
+	return fmt.Sprintf("invalid instance type: %T", e.instance)
+}